@@ -4,40 +4,145 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"math"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/imgurbot12/clamd"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/shenwei356/util/bytesize"
 )
 
 const (
 	clamdDBTimeFormat = "Mon Jan 2 15:04:05 2006"
+
+	defaultMaxDBAge = 48 * time.Hour
 )
 
 var (
+	// eicar is the anti-virus test file, see https://www.eicar.org/
+	eicar = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
 	clamdVersionRegexp = regexp.MustCompile(`^ClamAV (?P<clamav_version>.*?)/(?P<db_version>.*?)/(?P<db_date>.*?)$`)
 
-	clamdStatsQueueRegexp   = regexp.MustCompile(`^(\d+)\s+item.*$`)
-	clamdStatsThreadsRegexp = regexp.MustCompile(`^live\s+(\d+)\s+idle\s+(\d+)\s+max\s+(\d+)\s+idle-timeout\s+(\d+)$`)
-	clamdStatsMemRegexp     = regexp.MustCompile(`^heap\s+(\d+.\d+\w)\s+mmap\s+(\d+.\d+\w)\s+used\s+(\d+.\d+\w)\s+free\s+(\d+.\d+\w)\s+releasable\s+(\d+.\d+\w)` +
-		`\s+pools\s+(\d+)\s+pools_used\s+(\d+.\d+\w)\s+pools_total\s+(\d+.\d+\w)$`)
+	// clamdStatsStates are the values of STATE reported by STATS
+	clamdStatsStates = []string{"VALID PRIMARY", "VALID", "INVALID PRIMARY", "INVALID", "EXIT PRIMARY", "EXIT"}
+
+	clamdStatsQueueRegexp = regexp.MustCompile(`^(\d+)\s+item.*$`)
+
+	// clamdStatsSections are the lines of STATS which are parsed
+	clamdStatsSections = []string{"pools", "state", "threads", "queue", "memstats"}
+
+	errClamDStatsParse = errors.New("failed to parse clamd STATS")
 )
 
+// Location is a time zone which is read from an IANA name like
+// "Europe/Vienna" or "UTC" in the configuration file.
+type Location struct {
+	*time.Location
+}
+
+func (l *Location) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return err
+	}
+	l.Location = loc
+	return nil
+}
+
+// get returns the location or the local time zone of the exporter, if no
+// location has been configured.
+func (l Location) get() *time.Location {
+	if l.Location == nil {
+		return time.Local
+	}
+	return l.Location
+}
+
 type ClamDOptions struct {
 	URL string `json:"url"`
+	ProbeOptions
+	// Timezone clamd is running in, it reports the database time in local time
+	Timezone Location `json:"timezone"`
+	// MaxDBAge is the age after which the virus database is considered stale
+	MaxDBAge Duration `json:"max_db_age"`
+	// DatabaseDir is the directory of the database files used by clamd, to
+	// detect databases which have been updated but not loaded by clamd
+	DatabaseDir string `json:"database_dir"`
+	// Upstream enables the lookup of the published daily database version,
+	// to export how many versions clamd is behind
+	Upstream *UpstreamOptions `json:"upstream"`
+	// TLS wraps the connection to clamd, e.g. to reach it through stunnel
+	TLS *TLSOptions `json:"tls"`
+	// CommandPrefix selects how commands and replies are terminated, "z"
+	// (default) by a NUL character or "n" by a newline
+	CommandPrefix string `json:"command_prefix"`
+}
+
+func (o ClamDOptions) validate() error {
+	if err := o.ProbeOptions.validate(); err != nil {
+		return err
+	}
+	switch o.CommandPrefix {
+	case "", "z", "n":
+	default:
+		return fmt.Errorf("invalid clamd command prefix %q, must be z or n", o.CommandPrefix)
+	}
+	if o.TLS != nil {
+		return o.TLS.validate()
+	}
+	return nil
+}
+
+// delim returns the terminator of the commands and replies.
+func (o ClamDOptions) delim() byte {
+	if o.CommandPrefix == "n" {
+		return '\n'
+	}
+	return 0
 }
 
 type ClamDChecker struct {
+	name string
 	opts ClamDOptions
 
+	// mu protects the last result of background probes, the STATS lines
+	// that failed to parse, which are logged once, and since when a database
+	// reload is pending
+	mu                 sync.Mutex
+	last               *clamdResult
+	statsBadLines      map[string]string
+	reloadPendingSince time.Time
+	// upstream caches the published daily version, nil if disabled
+	upstream *upstreamCache
+
 	promClamDUp                 *prometheus.Desc
+	promClamDTLSHandshake       *prometheus.Desc
+	promClamDTLSCertExpiry      *prometheus.Desc
 	promClamDDBVersion          *prometheus.Desc
 	promClamDDBTime             *prometheus.Desc
+	promClamDDBAge              *prometheus.Desc
+	promClamDDBStale            *prometheus.Desc
+	promClamDDBDiskVersion      *prometheus.Desc
+	promClamDDBReloadPending    *prometheus.Desc
+	promClamDDBReloadPendingFor *prometheus.Desc
+	promUpstreamDailyVersion    *prometheus.Desc
+	promClamDDBVersionsBehind   *prometheus.Desc
+	promClamDStatsUp            *prometheus.Desc
+	promClamDStatsParseErrors   *prometheus.CounterVec
+	promClamDStatsPools         *prometheus.Desc
+	promClamDStatsState         *prometheus.Desc
 	promClamDStatsQueueLength   *prometheus.Desc
 	promClamDStatsThreadsLive   *prometheus.Desc
 	promClamDStatsThreadsIdle   *prometheus.Desc
@@ -50,105 +155,241 @@ type ClamDChecker struct {
 	promClamDStatsMemPools      *prometheus.Desc
 	promClamDStatsMemPoolsUsed  *prometheus.Desc
 	promClamDStatsMemPoolsTotal *prometheus.Desc
+	promClamDStatsJobsActive    *prometheus.Desc
+	promClamDStatsJobsOldestAge *prometheus.Desc
 	promClamDEicarDetected      *prometheus.Desc
 	promClamDEicarDetectionTime *prometheus.Desc
+	promClamDProbeTimeout       *prometheus.Desc
+	promClamDProbeDuration      *prometheus.Desc
+	promClamDProbeLatency       *prometheus.HistogramVec
+	verdicts                    *verdictTracker
+	promClamDLastProbeTime      *prometheus.Desc
+	promClamDProbeAge           *prometheus.Desc
 }
 
-func NewClamDChecker(opts ClamDOptions) *ClamDChecker {
-	return &ClamDChecker{
-		opts: opts,
+func NewClamDChecker(name string, opts ClamDOptions) *ClamDChecker {
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	if opts.MaxDBAge.Duration <= 0 {
+		opts.MaxDBAge.Duration = defaultMaxDBAge
+	}
+	if opts.Upstream != nil {
+		upstream := opts.Upstream.withDefaults()
+		opts.Upstream = &upstream
+	}
+	constLabels := instanceLabels(name)
+	c := &ClamDChecker{
+		name:          name,
+		opts:          opts,
+		statsBadLines: make(map[string]string),
 		promClamDUp: prometheus.NewDesc(
 			"clamav_clamd_up",
 			"connection to clamd is successful",
 			[]string{"version"},
-			nil),
+			constLabels),
+		promClamDTLSHandshake: prometheus.NewDesc(
+			"clamav_clamd_tls_handshake_seconds",
+			"duration of the TLS handshake with clamd",
+			[]string{},
+			constLabels),
+		promClamDTLSCertExpiry: prometheus.NewDesc(
+			"clamav_clamd_tls_cert_expiry_timestamp_seconds",
+			"unix epoch timestamp at which the certificate of clamd expires",
+			[]string{},
+			constLabels),
 		promClamDDBVersion: prometheus.NewDesc(
 			"clamav_clamd_db_version_info",
 			"version of currently used virus definition database",
 			[]string{},
-			nil),
+			constLabels),
 		promClamDDBTime: prometheus.NewDesc(
 			"clamav_clamd_db_time_info",
 			"unix epoch timestamp of currently used virus definition database",
 			[]string{},
-			nil),
+			constLabels),
+		promClamDDBAge: prometheus.NewDesc(
+			"clamav_clamd_db_age_seconds",
+			"age of currently used virus definition database",
+			[]string{},
+			constLabels),
+		promClamDDBStale: prometheus.NewDesc(
+			"clamav_clamd_db_stale",
+			"currently used virus definition database is older than the configured max_db_age",
+			[]string{},
+			constLabels),
+		promClamDDBDiskVersion: prometheus.NewDesc(
+			"clamav_clamd_db_disk_version",
+			"version of the daily virus definition database in the database directory",
+			[]string{},
+			constLabels),
+		promClamDDBReloadPending: prometheus.NewDesc(
+			"clamav_clamd_db_reload_pending",
+			"daily virus definition database on disk is newer than the one loaded by clamd",
+			[]string{},
+			constLabels),
+		promClamDDBReloadPendingFor: prometheus.NewDesc(
+			"clamav_clamd_db_reload_pending_seconds",
+			"time since the daily virus definition database on disk is newer than the one loaded by clamd",
+			[]string{},
+			constLabels),
+		promUpstreamDailyVersion: prometheus.NewDesc(
+			"clamav_upstream_daily_version",
+			"version of the daily virus definition database published in DNS",
+			[]string{},
+			constLabels),
+		promClamDDBVersionsBehind: prometheus.NewDesc(
+			"clamav_clamd_db_versions_behind",
+			"number of daily virus definition database versions clamd is behind the published one",
+			[]string{},
+			constLabels),
+		promClamDStatsUp: prometheus.NewDesc(
+			"clamav_clamd_stats_up",
+			"clamd STATS could be retrieved and parsed",
+			[]string{},
+			constLabels),
+		promClamDStatsParseErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "clamav_clamd_stats_parse_errors_total",
+			Help:        "number of clamd STATS lines which could not be parsed",
+			ConstLabels: constLabels,
+		}, []string{"section"}),
+		promClamDStatsPools: prometheus.NewDesc(
+			"clamav_clamd_stats_pools",
+			"number of clamd thread pools",
+			[]string{},
+			constLabels),
+		promClamDStatsState: prometheus.NewDesc(
+			"clamav_clamd_stats_state",
+			"state of the primary clamd thread pool",
+			[]string{"state"},
+			constLabels),
 		promClamDStatsQueueLength: prometheus.NewDesc(
 			"clamav_clamd_stats_queue_length",
 			"mumber of items in clamd queue",
 			[]string{},
-			nil),
+			constLabels),
 		promClamDStatsThreadsLive: prometheus.NewDesc(
 			"clamav_clamd_stats_threads_live",
 			"number of busy clamd threads",
 			[]string{},
-			nil),
+			constLabels),
 		promClamDStatsThreadsIdle: prometheus.NewDesc(
 			"clamav_clamd_stats_threads_idle",
 			"number of idle clamd threads",
 			[]string{},
-			nil),
+			constLabels),
 		promClamDStatsThreadsMax: prometheus.NewDesc(
 			"clamav_clamd_stats_threads_max",
 			"maximum number of clamd threads",
 			[]string{},
-			nil),
+			constLabels),
 		promClamDStatsMemHeap: prometheus.NewDesc(
 			"clamav_clamd_stats_mem_heap_bytes",
 			"amount of memory used by libc from the heap",
 			[]string{},
-			nil),
+			constLabels),
 		promClamDStatsMemMMap: prometheus.NewDesc(
 			"clamav_clamd_stats_mem_mmap_bytes",
 			"amount of memory used by libc from mmap-allocated memory",
 			[]string{},
-			nil),
+			constLabels),
 		promClamDStatsMemUsed: prometheus.NewDesc(
 			"clamav_clamd_stats_mem_used_bytes",
 			"amount of useful memory allocated by libc",
 			[]string{},
-			nil),
+			constLabels),
 		promClamDStatsMemFree: prometheus.NewDesc(
 			"clamav_clamd_stats_mem_free_bytes",
 			"amount of memory allocated by libc, that can't be freed due to fragmentation",
 			[]string{},
-			nil),
+			constLabels),
 		promClamDStatsMemReleasable: prometheus.NewDesc(
 			"clamav_clamd_stats_mem_realeasable_bytes",
 			"amount of memory that can be reclaimed by libc",
 			[]string{},
-			nil),
+			constLabels),
 		promClamDStatsMemPools: prometheus.NewDesc(
 			"clamav_clamd_stats_mem_pools",
 			"number of mmap regions allocated by clamd's memory pool allocator",
 			[]string{},
-			nil),
+			constLabels),
 		promClamDStatsMemPoolsUsed: prometheus.NewDesc(
 			"clamav_clamd_stats_mem_pools_used_bytes",
 			"amount of memory used by clamd's memory pool allocator",
 			[]string{},
-			nil),
+			constLabels),
 		promClamDStatsMemPoolsTotal: prometheus.NewDesc(
 			"clamav_clamd_stats_mem_pools_total_bytes",
 			"total amount of memory allocated by clamd's memory pool allocator",
 			[]string{},
-			nil),
+			constLabels),
+		promClamDStatsJobsActive: prometheus.NewDesc(
+			"clamav_clamd_stats_jobs_active",
+			"number of jobs currently processed by clamd",
+			[]string{},
+			constLabels),
+		promClamDStatsJobsOldestAge: prometheus.NewDesc(
+			"clamav_clamd_stats_jobs_oldest_age_seconds",
+			"time the oldest job currently processed by clamd has been running",
+			[]string{},
+			constLabels),
 		promClamDEicarDetected: prometheus.NewDesc(
 			"clamav_clamd_eicar_detected",
 			"successfully detected eicar test stream",
 			[]string{},
-			nil),
+			constLabels),
 		promClamDEicarDetectionTime: prometheus.NewDesc(
 			"clamav_clamd_eicar_detection_time_seconds",
 			"eicar test stream detection time",
 			[]string{},
-			nil),
+			constLabels),
+		promClamDProbeTimeout: prometheus.NewDesc(
+			"clamav_clamd_probe_timeout",
+			"probe has been aborted because it exceeded its timeout",
+			[]string{"probe"},
+			constLabels),
+		promClamDProbeDuration: prometheus.NewDesc(
+			"clamav_clamd_probe_duration_seconds",
+			"time it took to run the probe",
+			[]string{"probe"},
+			constLabels),
+		promClamDProbeLatency: newProbeLatency("clamd", opts.LatencyBuckets, constLabels),
+		verdicts:              newVerdictTracker("clamd", []string{"eicar"}, constLabels),
+		promClamDLastProbeTime: prometheus.NewDesc(
+			"clamav_clamd_last_probe_timestamp_seconds",
+			"unix epoch timestamp of the last probe",
+			[]string{},
+			constLabels),
+		promClamDProbeAge: prometheus.NewDesc(
+			"clamav_clamd_probe_age_seconds",
+			"age of the probe results served by this scrape",
+			[]string{},
+			constLabels),
+	}
+	for _, section := range clamdStatsSections {
+		c.promClamDStatsParseErrors.WithLabelValues(section)
+	}
+	if opts.Upstream != nil {
+		c.upstream = newUpstreamCache(*opts.Upstream)
 	}
+	return c
 }
 
 func (c *ClamDChecker) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.promClamDUp
+	ch <- c.promClamDTLSHandshake
+	ch <- c.promClamDTLSCertExpiry
 	ch <- c.promClamDDBVersion
 	ch <- c.promClamDDBTime
+	ch <- c.promClamDDBAge
+	ch <- c.promClamDDBStale
+	ch <- c.promClamDDBDiskVersion
+	ch <- c.promClamDDBReloadPending
+	ch <- c.promClamDDBReloadPendingFor
+	ch <- c.promUpstreamDailyVersion
+	ch <- c.promClamDDBVersionsBehind
+	ch <- c.promClamDStatsUp
+	c.promClamDStatsParseErrors.Describe(ch)
+	ch <- c.promClamDStatsPools
+	ch <- c.promClamDStatsState
 	ch <- c.promClamDStatsQueueLength
 	ch <- c.promClamDStatsThreadsLive
 	ch <- c.promClamDStatsThreadsIdle
@@ -161,119 +402,409 @@ func (c *ClamDChecker) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.promClamDStatsMemPools
 	ch <- c.promClamDStatsMemPoolsUsed
 	ch <- c.promClamDStatsMemPoolsTotal
+	ch <- c.promClamDStatsJobsActive
+	ch <- c.promClamDStatsJobsOldestAge
 	ch <- c.promClamDEicarDetected
 	ch <- c.promClamDEicarDetectionTime
+	ch <- c.promClamDProbeTimeout
+	ch <- c.promClamDProbeDuration
+	c.promClamDProbeLatency.Describe(ch)
+	c.verdicts.Describe(ch)
+	ch <- c.promClamDLastProbeTime
+	ch <- c.promClamDProbeAge
 }
 
 func (c *ClamDChecker) Collect(ch chan<- prometheus.Metric) {
+	c.CollectContext(context.Background(), ch)
+}
+
+func (c *ClamDChecker) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	if c.opts.Background.enabled() {
+		c.mu.Lock()
+		last := c.last
+		c.mu.Unlock()
+		if last != nil {
+			c.collect(ch, *last)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeouts.Overall.Duration)
+	defer cancel()
+	c.collect(ch, c.probe(ctx))
+}
+
+// Run probes clamd in the background until ctx is done, see BackgroundOptions.
+func (c *ClamDChecker) Run(ctx context.Context) {
+	runBackground(ctx, c.opts.Background, func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, c.opts.Timeouts.Overall.Duration)
+		defer cancel()
+		res := c.probe(ctx)
+
+		c.mu.Lock()
+		c.last = &res
+		c.mu.Unlock()
+	})
+}
+
+// clamdResult holds the outcome of all probes of a single scrape.
+type clamdResult struct {
+	versionErr    error
+	version       string
+	dbVersion     float64
+	dbTime        float64
+	stats         clamdStats
+	eicarDetected int
+	eicarTime     float64
+	probes        []probeStatus
+	time          time.Time
+
+	// daily database version on disk, if a database directory is configured
+	diskErr            error
+	diskVersion        float64
+	reloadPendingSince time.Time
+
+	// daily database version published in DNS, if enabled
+	upstreamVersion float64
+
+	// the TLS connection to clamd, if enabled
+	tls *tlsState
+}
+
+func (c *ClamDChecker) probe(ctx context.Context) (res clamdResult) {
+	res.time = time.Now()
+	res.stats = newClamdStats()
+	res.eicarTime = math.NaN()
+	res.upstreamVersion = math.NaN()
+
+	cl, connErr := c.connect(ctx)
+	if connErr == nil {
+		res.tls = cl.tls
+		defer func() {
+			cl.EndSession()
+			cl.Close()
+		}()
+	}
+	withClient := func(fn func(cl *clamdClient) error) func(context.Context) error {
+		return func(context.Context) error {
+			if connErr != nil {
+				return connErr
+			}
+			return fn(cl)
+		}
+	}
+
+	probes := []probe{
+		{"version", withClient(func(cl *clamdClient) (err error) {
+			res.version, res.dbVersion, res.dbTime, err = c.collectVersion(cl)
+			return
+		})},
+		{"stats", withClient(func(cl *clamdClient) (err error) {
+			res.stats, err = c.collectStats(cl)
+			return
+		})},
+		{"eicar", withClient(func(cl *clamdClient) (err error) {
+			res.eicarDetected, res.eicarTime, err = c.collectEicar(cl)
+			return
+		})},
+	}
+	if c.opts.Upstream != nil {
+		probes = append(probes, probe{"upstream", func(ctx context.Context) error {
+			version, err := c.upstream.get(ctx)
+			if version > 0 {
+				res.upstreamVersion = float64(version)
+			}
+			return err
+		}})
+	}
+	res.probes = runProbes(ctx, c.opts.Parallelism, probes)
+	logProbeErrors("clamd", c.name, c.opts.URL, res.probes)
+	observeProbes(c.promClamDProbeLatency, res.probes)
+	c.verdicts.observe(res.time, []scanVerdict{
+		{"eicar", true, res.eicarDetected == 1, probeErr(res.probes, "eicar")},
+	})
+	res.versionErr = probeErr(res.probes, "version")
+	if c.opts.DatabaseDir != "" {
+		c.compareDiskVersion(&res)
+	}
+	return
+}
+
+// compareDiskVersion compares the daily database version reported by clamd
+// with the one on disk. If freshclam has updated the database but clamd has
+// not reloaded it, the time since when the reload is pending is tracked.
+func (c *ClamDChecker) compareDiskVersion(res *clamdResult) {
+	res.diskVersion = math.NaN()
+	var h cvdHeader
+	if h, _, res.diskErr = findDatabase(c.opts.DatabaseDir, "daily"); res.diskErr != nil {
+		return
+	}
+	res.diskVersion = float64(h.Version)
+	if res.versionErr != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if res.diskVersion > res.dbVersion {
+		if c.reloadPendingSince.IsZero() {
+			c.reloadPendingSince = res.time
+		}
+	} else {
+		c.reloadPendingSince = time.Time{}
+	}
+	res.reloadPendingSince = c.reloadPendingSince
+}
+
+func (c *ClamDChecker) collect(ch chan<- prometheus.Metric, res clamdResult) {
 	up := 1.0
-	version, dbVersion, dbTime, err := c.collectVersion()
-	if err != nil {
+	if res.versionErr != nil {
 		up = 0.0
-		dbVersion = math.NaN()
-		dbTime = math.NaN()
+		res.dbVersion = math.NaN()
+		res.dbTime = math.NaN()
 	}
 
 	ch <- prometheus.MustNewConstMetric(
 		c.promClamDUp,
 		prometheus.GaugeValue,
 		up,
-		version,
+		res.version,
 	)
+	collectTLS(ch, c.promClamDTLSHandshake, c.promClamDTLSCertExpiry, res.tls)
 	ch <- prometheus.MustNewConstMetric(
 		c.promClamDDBVersion,
 		prometheus.GaugeValue,
-		dbVersion,
+		res.dbVersion,
 	)
 	ch <- prometheus.MustNewConstMetric(
 		c.promClamDDBTime,
 		prometheus.GaugeValue,
-		dbTime,
+		res.dbTime,
+	)
+
+	dbAge := float64(time.Now().Unix()) - res.dbTime
+	dbStale := math.NaN()
+	if !math.IsNaN(dbAge) {
+		dbStale = boolToFloat(dbAge > c.opts.MaxDBAge.Seconds())
+	}
+	ch <- prometheus.MustNewConstMetric(
+		c.promClamDDBAge,
+		prometheus.GaugeValue,
+		dbAge,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		c.promClamDDBStale,
+		prometheus.GaugeValue,
+		dbStale,
 	)
 
-	stats, _ := c.collectStats()
+	if c.opts.DatabaseDir != "" {
+		reloadPending := math.NaN()
+		reloadPendingFor := math.NaN()
+		if res.diskErr == nil && res.versionErr == nil {
+			reloadPending = boolToFloat(!res.reloadPendingSince.IsZero())
+			reloadPendingFor = 0
+			if !res.reloadPendingSince.IsZero() {
+				reloadPendingFor = time.Since(res.reloadPendingSince).Seconds()
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(
+			c.promClamDDBDiskVersion,
+			prometheus.GaugeValue,
+			res.diskVersion,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.promClamDDBReloadPending,
+			prometheus.GaugeValue,
+			reloadPending,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.promClamDDBReloadPendingFor,
+			prometheus.GaugeValue,
+			reloadPendingFor,
+		)
+	}
+
+	if c.opts.Upstream != nil {
+		// NaN if either version is unknown, 0 if clamd is ahead of a lagging
+		// mirror
+		versionsBehind := math.Max(res.upstreamVersion-res.dbVersion, 0)
+		ch <- prometheus.MustNewConstMetric(
+			c.promUpstreamDailyVersion,
+			prometheus.GaugeValue,
+			res.upstreamVersion,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.promClamDDBVersionsBehind,
+			prometheus.GaugeValue,
+			versionsBehind,
+		)
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		c.promClamDStatsUp,
+		prometheus.GaugeValue,
+		boolToFloat(probeErr(res.probes, "stats") == nil),
+	)
+	c.promClamDStatsParseErrors.Collect(ch)
+	ch <- prometheus.MustNewConstMetric(
+		c.promClamDStatsPools,
+		prometheus.GaugeValue,
+		res.stats.Pools,
+	)
+	c.collectState(ch, res.stats.State)
 	ch <- prometheus.MustNewConstMetric(
 		c.promClamDStatsQueueLength,
 		prometheus.GaugeValue,
-		stats.Queue.Length,
+		res.stats.Queue.Length,
 	)
 
 	ch <- prometheus.MustNewConstMetric(
 		c.promClamDStatsThreadsLive,
 		prometheus.GaugeValue,
-		stats.Threads.Live,
+		res.stats.Threads.Live,
 	)
 	ch <- prometheus.MustNewConstMetric(
 		c.promClamDStatsThreadsIdle,
 		prometheus.GaugeValue,
-		stats.Threads.Idle,
+		res.stats.Threads.Idle,
 	)
 	ch <- prometheus.MustNewConstMetric(
 		c.promClamDStatsThreadsMax,
 		prometheus.GaugeValue,
-		stats.Threads.Max,
+		res.stats.Threads.Max,
 	)
 
 	ch <- prometheus.MustNewConstMetric(
 		c.promClamDStatsMemHeap,
 		prometheus.GaugeValue,
-		stats.Mem.Heap,
+		res.stats.Mem.Heap,
 	)
 	ch <- prometheus.MustNewConstMetric(
 		c.promClamDStatsMemMMap,
 		prometheus.GaugeValue,
-		stats.Mem.MMap,
+		res.stats.Mem.MMap,
 	)
 	ch <- prometheus.MustNewConstMetric(
 		c.promClamDStatsMemUsed,
 		prometheus.GaugeValue,
-		stats.Mem.Used,
+		res.stats.Mem.Used,
 	)
 	ch <- prometheus.MustNewConstMetric(
 		c.promClamDStatsMemFree,
 		prometheus.GaugeValue,
-		stats.Mem.Free,
+		res.stats.Mem.Free,
 	)
 	ch <- prometheus.MustNewConstMetric(
 		c.promClamDStatsMemReleasable,
 		prometheus.GaugeValue,
-		stats.Mem.Releasable,
+		res.stats.Mem.Releasable,
 	)
 	ch <- prometheus.MustNewConstMetric(
 		c.promClamDStatsMemPools,
 		prometheus.GaugeValue,
-		stats.Mem.Pools.Count,
+		res.stats.Mem.Pools.Count,
 	)
 	ch <- prometheus.MustNewConstMetric(
 		c.promClamDStatsMemPoolsUsed,
 		prometheus.GaugeValue,
-		stats.Mem.Pools.Used,
+		res.stats.Mem.Pools.Used,
 	)
 	ch <- prometheus.MustNewConstMetric(
 		c.promClamDStatsMemPoolsTotal,
 		prometheus.GaugeValue,
-		stats.Mem.Pools.Total,
+		res.stats.Mem.Pools.Total,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.promClamDStatsJobsActive,
+		prometheus.GaugeValue,
+		res.stats.Jobs.Active,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		c.promClamDStatsJobsOldestAge,
+		prometheus.GaugeValue,
+		res.stats.Jobs.OldestAge,
 	)
 
-	eicarDetected, eicarTime, _ := c.collectEicar()
 	ch <- prometheus.MustNewConstMetric(
 		c.promClamDEicarDetected,
 		prometheus.GaugeValue,
-		float64(eicarDetected),
+		float64(res.eicarDetected),
 	)
 	ch <- prometheus.MustNewConstMetric(
 		c.promClamDEicarDetectionTime,
 		prometheus.GaugeValue,
-		eicarTime,
+		res.eicarTime,
+	)
+
+	for _, p := range res.probes {
+		ch <- prometheus.MustNewConstMetric(
+			c.promClamDProbeTimeout,
+			prometheus.GaugeValue,
+			boolToFloat(isTimeout(p.err)),
+			p.name,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.promClamDProbeDuration,
+			prometheus.GaugeValue,
+			p.duration.Seconds(),
+			p.name,
+		)
+	}
+	c.promClamDProbeLatency.Collect(ch)
+	c.verdicts.Collect(ch)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.promClamDLastProbeTime,
+		prometheus.GaugeValue,
+		float64(res.time.UnixNano())/1e9,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		c.promClamDProbeAge,
+		prometheus.GaugeValue,
+		time.Since(res.time).Seconds(),
 	)
 }
 
-func (c *ClamDChecker) collectVersion() (version string, dbVersion, dbTime float64, err error) {
-	var cl *clamd.ClamD
-	if cl, err = clamd.NewClamd(c.opts.URL); err != nil {
-		return
+// collectState exports the pool state as enum, unknown states are exported
+// as well.
+func (c *ClamDChecker) collectState(ch chan<- prometheus.Metric, state string) {
+	known := false
+	for _, s := range clamdStatsStates {
+		known = known || s == state
+		ch <- prometheus.MustNewConstMetric(
+			c.promClamDStatsState,
+			prometheus.GaugeValue,
+			boolToFloat(s == state),
+			s,
+		)
+	}
+	if !known && state != "" {
+		ch <- prometheus.MustNewConstMetric(
+			c.promClamDStatsState,
+			prometheus.GaugeValue,
+			1,
+			state,
+		)
+	}
+}
+
+// connect opens a connection to clamd and starts a session, which is shared
+// by all probes of a scrape.
+func (c *ClamDChecker) connect(ctx context.Context) (*clamdClient, error) {
+	cl, err := dialClamD(ctx, c.opts.URL, c.opts.delim(), c.opts.Timeouts, c.opts.TLS)
+	if err != nil {
+		return nil, err
 	}
+	if err := cl.StartSession(); err != nil {
+		cl.Close()
+		return nil, err
+	}
+	return cl, nil
+}
 
+func (c *ClamDChecker) collectVersion(cl *clamdClient) (version string, dbVersion, dbTime float64, err error) {
 	var v string
 	if v, err = cl.Version(); err != nil {
 		return
@@ -292,10 +823,10 @@ func (c *ClamDChecker) collectVersion() (version string, dbVersion, dbTime float
 	}
 	dbVersion = float64(dbVersionValue)
 
-	// clamd reports the db time in local time, for now we assume that the system timezone of the host clamd
-	// is running on is the same as on the host the exporter is running on, TODO: add a config option for this
+	// clamd reports the db time in its local time, unless configured otherwise we assume that the system timezone
+	// of the host clamd is running on is the same as on the host the exporter is running on
 	var dbTimeValue time.Time
-	if dbTimeValue, err = time.ParseInLocation(clamdDBTimeFormat, matches[3], time.Local); err != nil {
+	if dbTimeValue, err = time.ParseInLocation(clamdDBTimeFormat, matches[3], c.opts.Timezone.get()); err != nil {
 		return
 	}
 	dbTime = float64(dbTimeValue.Unix())
@@ -303,6 +834,8 @@ func (c *ClamDChecker) collectVersion() (version string, dbVersion, dbTime float
 }
 
 type clamdStats struct {
+	Pools float64
+	State string
 	Queue struct {
 		Length float64
 	}
@@ -324,6 +857,10 @@ type clamdStats struct {
 			Total float64
 		}
 	}
+	Jobs struct {
+		Active    float64
+		OldestAge float64
+	}
 }
 
 func cvtInt(number string) float64 {
@@ -334,15 +871,33 @@ func cvtInt(number string) float64 {
 	return float64(v)
 }
 
-func cvtByteSize(number string) float64 {
-	v, err := bytesize.Parse([]byte(number))
+// cvtMemSize converts a memory size like "9.082M" or "12KiB" to bytes. Sizes
+// which are not available on a platform ("N/A", e.g. on musl) are NaN but no
+// error.
+func cvtMemSize(size string) (float64, bool) {
+	if size == "N/A" {
+		return math.NaN(), true
+	}
+	v, err := bytesize.Parse([]byte(strings.Replace(size, "iB", "B", 1)))
 	if err != nil {
-		return math.NaN()
+		return math.NaN(), false
 	}
-	return float64(v)
+	return float64(v), true
 }
 
-func (c *ClamDChecker) collectStats() (stats clamdStats, err error) {
+// parseClamdStatsFields parses the "key value" pairs of the THREADS and
+// MEMSTATS lines.
+func parseClamdStatsFields(line string) map[string]string {
+	f := strings.Fields(line)
+	fields := make(map[string]string, len(f)/2)
+	for i := 0; i+1 < len(f); i += 2 {
+		fields[f[i]] = f[i+1]
+	}
+	return fields
+}
+
+func newClamdStats() (stats clamdStats) {
+	stats.Pools = math.NaN()
 	stats.Queue.Length = math.NaN()
 	stats.Threads.Live = math.NaN()
 	stats.Threads.Idle = math.NaN()
@@ -355,60 +910,174 @@ func (c *ClamDChecker) collectStats() (stats clamdStats, err error) {
 	stats.Mem.Pools.Count = math.NaN()
 	stats.Mem.Pools.Used = math.NaN()
 	stats.Mem.Pools.Total = math.NaN()
+	stats.Jobs.Active = math.NaN()
+	stats.Jobs.OldestAge = math.NaN()
+	return
+}
 
-	var cl *clamd.ClamD
-	if cl, err = clamd.NewClamd(c.opts.URL); err != nil {
+func (c *ClamDChecker) collectStats(cl *clamdClient) (stats clamdStats, err error) {
+	var raw string
+	if raw, err = cl.Stats(); err != nil {
+		stats = newClamdStats()
 		return
 	}
 
-	var s *clamd.ClamDStats
-	if s, err = cl.Stats(); err != nil {
-		return
+	var parseErrs []clamdStatsError
+	stats, parseErrs = parseClamdStats(raw)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sections []string
+	for _, e := range parseErrs {
+		c.promClamDStatsParseErrors.WithLabelValues(e.section).Inc()
+		sections = append(sections, e.section)
+		if c.statsBadLines[e.section] != e.line {
+			c.statsBadLines[e.section] = e.line
+			logger.Warn("failed to parse clamd STATS line",
+				"instance", c.name,
+				"target", c.opts.URL,
+				"section", e.section,
+				"line", e.line)
+		}
+	}
+	// the raw lines change with every scrape, the probe error does not, so
+	// that it is rate-limited like other errors of the same class
+	if len(sections) > 0 {
+		err = fmt.Errorf("%w: %s", errClamDStatsParse, strings.Join(sections, ", "))
+	}
+	return
+}
+
+// clamdStatsError is a section of STATS which could not be parsed.
+type clamdStatsError struct {
+	section string
+	line    string
+}
+
+// parseClamdStats parses the reply to STATS. If clamd runs several thread
+// pools, the pool values are taken from the first (primary) one, while the
+// jobs of all pools are counted.
+func parseClamdStats(raw string) (stats clamdStats, errs []clamdStatsError) {
+	stats = newClamdStats()
+	stats.Jobs.Active = 0
+	stats.Jobs.OldestAge = 0
+
+	var s struct {
+		Pools, State, Threads, Queue, Memstats string
+	}
+	for _, l := range strings.Split(raw, "\n") {
+		if strings.HasPrefix(l, "\t") {
+			// a non-empty queue is summarized by a min_wait line, followed
+			// by the jobs which are currently processed
+			if strings.HasPrefix(strings.TrimSpace(l), "min_wait:") {
+				continue
+			}
+			if age, ok := parseClamdStatsJob(l); ok {
+				stats.Jobs.Active++
+				stats.Jobs.OldestAge = math.Max(stats.Jobs.OldestAge, age)
+			}
+			continue
+		}
+
+		l = strings.TrimSpace(l)
+		switch {
+		case strings.HasPrefix(l, "POOLS: "):
+			s.Pools = strings.TrimPrefix(l, "POOLS: ")
+		case strings.HasPrefix(l, "STATE: "):
+			if s.State == "" {
+				s.State = strings.TrimPrefix(l, "STATE: ")
+			}
+		case strings.HasPrefix(l, "THREADS: "):
+			if s.Threads == "" {
+				s.Threads = strings.TrimPrefix(l, "THREADS: ")
+			}
+		case strings.HasPrefix(l, "QUEUE: "):
+			if s.Queue == "" {
+				s.Queue = strings.TrimPrefix(l, "QUEUE: ")
+			}
+		case strings.HasPrefix(l, "MEMSTATS: "):
+			s.Memstats = strings.TrimPrefix(l, "MEMSTATS: ")
+		}
+	}
+
+	fail := func(section, line string) {
+		errs = append(errs, clamdStatsError{section, line})
+	}
+
+	if stats.Pools = cvtInt(s.Pools); math.IsNaN(stats.Pools) {
+		fail("pools", s.Pools)
+	}
+	if stats.State = strings.TrimSpace(s.State); stats.State == "" {
+		fail("state", s.State)
 	}
 
 	q := clamdStatsQueueRegexp.FindStringSubmatch(s.Queue)
 	if len(q) == 2 {
 		stats.Queue.Length = cvtInt(q[1])
+	} else {
+		fail("queue", s.Queue)
 	}
 
-	t := clamdStatsThreadsRegexp.FindStringSubmatch(s.Threads)
-	if len(t) == 5 {
-		stats.Threads.Live = cvtInt(t[1])
-		stats.Threads.Idle = cvtInt(t[2])
-		stats.Threads.Max = cvtInt(t[3])
+	t := parseClamdStatsFields(s.Threads)
+	stats.Threads.Live = cvtInt(t["live"])
+	stats.Threads.Idle = cvtInt(t["idle"])
+	stats.Threads.Max = cvtInt(t["max"])
+	if math.IsNaN(stats.Threads.Live) || math.IsNaN(stats.Threads.Idle) || math.IsNaN(stats.Threads.Max) {
+		fail("threads", s.Threads)
 	}
 
-	m := clamdStatsMemRegexp.FindStringSubmatch(s.Memstats)
-	if len(m) == 9 {
-		stats.Mem.Heap = cvtByteSize(m[1])
-		stats.Mem.MMap = cvtByteSize(m[2])
-		stats.Mem.Used = cvtByteSize(m[3])
-		stats.Mem.Free = cvtByteSize(m[4])
-		stats.Mem.Releasable = cvtByteSize(m[5])
-		stats.Mem.Pools.Count = cvtInt(m[6])
-		stats.Mem.Pools.Used = cvtByteSize(m[7])
-		stats.Mem.Pools.Total = cvtByteSize(m[8])
+	m := parseClamdStatsFields(s.Memstats)
+	memOK := true
+	for _, v := range []struct {
+		key   string
+		value *float64
+	}{
+		{"heap", &stats.Mem.Heap},
+		{"mmap", &stats.Mem.MMap},
+		{"used", &stats.Mem.Used},
+		{"free", &stats.Mem.Free},
+		{"releasable", &stats.Mem.Releasable},
+		{"pools_used", &stats.Mem.Pools.Used},
+		{"pools_total", &stats.Mem.Pools.Total},
+	} {
+		var ok bool
+		*v.value, ok = cvtMemSize(m[v.key])
+		memOK = memOK && ok
+	}
+	stats.Mem.Pools.Count = cvtInt(m["pools"])
+	if !memOK || math.IsNaN(stats.Mem.Pools.Count) {
+		fail("memstats", s.Memstats)
 	}
 
 	return
 }
 
-func (c *ClamDChecker) collectEicar() (detected int, elapsed float64, err error) {
-	elapsed = math.NaN()
-
-	var cl *clamd.ClamD
-	if cl, err = clamd.NewClamd(c.opts.URL); err != nil {
+// parseClamdStatsJob parses a job line like "\tSCAN 10.123 /tmp/file" and
+// returns for how long the job has been running. The STATS job, which
+// produces the reply, is ignored.
+func parseClamdStatsJob(line string) (age float64, ok bool) {
+	f := strings.Fields(line)
+	if len(f) < 2 || f[0] == "STATS" {
+		return
+	}
+	var err error
+	if age, err = strconv.ParseFloat(f[1], 64); err != nil {
 		return
 	}
+	return age, true
+}
+
+func (c *ClamDChecker) collectEicar(cl *clamdClient) (detected int, elapsed float64, err error) {
+	elapsed = math.NaN()
 
 	start := time.Now()
-	var results []*clamd.Result
-	results, err = cl.ScanBytes(clamd.EICAR)
+	var res clamdScanResult
+	res, err = cl.Instream(eicar)
 	elapsed = time.Since(start).Seconds()
-	if err != nil || len(results) != 1 {
+	if err != nil {
 		return
 	}
-	if results[0].Status == clamd.RES_FOUND {
+	if res.Found {
 		detected = 1
 	}
 	return
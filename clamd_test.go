@@ -4,9 +4,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 )
 
@@ -29,3 +36,214 @@ func TestParseVersion(t *testing.T) {
 	r.NoError(err)
 	r.Equal(dbTime.Unix(), dbTimeEpoch)
 }
+
+func TestRegisterNamedCheckers(t *testing.T) {
+	r := require.New(t)
+	registry := prometheus.NewPedanticRegistry()
+	r.NoError(registry.Register(NewClamDChecker("mail1", ClamDOptions{})))
+	r.NoError(registry.Register(NewClamDChecker("mail2", ClamDOptions{})))
+	r.Error(registry.Register(NewClamDChecker("mail2", ClamDOptions{})))
+}
+
+func TestParseStats(t *testing.T) {
+	r := require.New(t)
+
+	stats, errs := parseClamdStats(fakeClamDStats)
+	r.Empty(errs)
+	r.Equal(1.0, stats.Pools)
+	r.Equal("VALID PRIMARY", stats.State)
+	r.Equal(0.0, stats.Queue.Length)
+	r.Equal(1.0, stats.Threads.Live)
+	r.Equal(0.0, stats.Threads.Idle)
+	r.Equal(12.0, stats.Threads.Max)
+	r.Equal(0.0, stats.Jobs.Active)
+	r.Equal(0.0, stats.Jobs.OldestAge)
+	r.Equal(1.0, stats.Mem.Pools.Count)
+
+	// the queue of the primary pool is summarized by a min_wait line, like
+	// clamd's print_queue in thrmgr.c writes it
+	raw, err := ioutil.ReadFile("testdata/clamd-stats-queue.txt")
+	r.NoError(err)
+	stats, errs = parseClamdStats(string(raw))
+	r.Empty(errs)
+	r.Equal(3.0, stats.Queue.Length)
+	r.Equal(4.0, stats.Threads.Live)
+	r.Equal(3.0, stats.Jobs.Active)
+	r.Equal(412.603218, stats.Jobs.OldestAge)
+
+	// two pools with a queued and three running jobs
+	stats, errs = parseClamdStats("POOLS: 2\n\n" +
+		"STATE: VALID PRIMARY\n" +
+		"THREADS: live 3  idle 0 max 3 idle-timeout 30\n" +
+		"QUEUE: 1 items\n" +
+		"\tmin_wait: 0.500000 max_wait: 0.500000 avg_wait: 0.500000\n" +
+		"\tINSTREAM 300.250000 \n" +
+		"\tSCAN 12.000000 /var/spool/mail/big.tar\n" +
+		"\tSTATS 0.000394\n" +
+		"\n" +
+		"STATE: VALID\n" +
+		"THREADS: live 1  idle 0 max 1 idle-timeout 30\n" +
+		"QUEUE: 0 items\n" +
+		"\tMULTISCAN 7.500000 /srv\n" +
+		"\n" +
+		"MEMSTATS: heap 9.082M mmap 0.000M used 6.902M free 2.184M releasable 0.129M pools 1 pools_used 565.979M pools_total 565.999M\n" +
+		"END")
+	r.Equal(2.0, stats.Pools)
+	r.Equal("VALID PRIMARY", stats.State)
+	r.Equal(1.0, stats.Queue.Length)
+	r.Equal(3.0, stats.Threads.Live)
+	r.Equal(3.0, stats.Jobs.Active)
+	r.Equal(300.25, stats.Jobs.OldestAge)
+	r.Empty(errs)
+
+	// musl reports N/A for the libc values, other versions use other units
+	stats, errs = parseClamdStats("POOLS: 1\n\n" +
+		"STATE: VALID PRIMARY\n" +
+		"THREADS: live 1  idle 0 max 10 idle-timeout 30\n" +
+		"QUEUE: 0 items\n" +
+		"\n" +
+		"MEMSTATS: heap N/A mmap N/A used N/A free N/A releasable N/A pools 1 pools_used 1.5MiB pools_total 2G\n" +
+		"END")
+	r.Empty(errs)
+	r.True(math.IsNaN(stats.Mem.Heap))
+	r.Equal(1.5*1024*1024, stats.Mem.Pools.Used)
+	r.Equal(2.0*1024*1024*1024, stats.Mem.Pools.Total)
+
+	stats, errs = parseClamdStats("POOLS: 1\n\n" +
+		"STATE: VALID PRIMARY\n" +
+		"THREADS: busy 1 max 10\n" +
+		"QUEUE: 0 items\n" +
+		"\n" +
+		"MEMSTATS: heap 9.082 megabytes\n" +
+		"END")
+	r.Equal([]clamdStatsError{
+		{"threads", "busy 1 max 10"},
+		{"memstats", "heap 9.082 megabytes"},
+	}, errs)
+	r.True(math.IsNaN(stats.Threads.Live))
+	r.Equal(0.0, stats.Queue.Length)
+}
+
+func TestClamDTimezone(t *testing.T) {
+	r := require.New(t)
+	f := newFakeClamD(t)
+	defer f.Close()
+
+	for _, tz := range []struct {
+		name   string
+		offset int64
+	}{
+		{"UTC", 0},
+		{"Europe/Vienna", -3600},
+	} {
+		var opts ClamDOptions
+		r.NoError(json.Unmarshal([]byte(`{"url": "`+f.URL()+`", "timezone": "`+tz.name+`"}`), &opts))
+		c := NewClamDChecker("", opts)
+		res := c.probe(context.Background())
+		r.NoError(res.versionErr)
+		r.Equal(float64(dbTimeEpoch+tz.offset), res.dbTime, tz.name)
+	}
+
+	var opts ClamDOptions
+	r.Error(json.Unmarshal([]byte(`{"timezone": "Mars/Olympus_Mons"}`), &opts))
+}
+
+func TestClamDCheckerGather(t *testing.T) {
+	r := require.New(t)
+	f := newFakeClamD(t)
+	defer f.Close()
+
+	values := gatherMetrics(t, NewClamDChecker("mail", ClamDOptions{
+		URL:      f.URL(),
+		MaxDBAge: Duration{time.Hour},
+	}))
+	r.Equal(1.0, values["clamav_clamd_up"])
+	r.Equal(1.0, values["clamav_clamd_stats_up"])
+	r.Equal(1.0, values["clamav_clamd_eicar_detected"])
+	r.Equal(1.0, values["clamav_clamd_db_stale"])
+	r.True(values["clamav_clamd_db_age_seconds"] > 0)
+}
+
+func TestClamDCheckerLatency(t *testing.T) {
+	r := require.New(t)
+	f := newFakeClamD(t)
+	defer f.Close()
+
+	c := NewClamDChecker("", ClamDOptions{
+		URL: f.URL(),
+		ProbeOptions: ProbeOptions{
+			LatencyBuckets: []float64{0.5, 5},
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// every probe is recorded, like in background mode, not only the last one
+	for i := 0; i < 3; i++ {
+		c.probe(ctx)
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	r.NoError(registry.Register(c))
+	mfs, err := registry.Gather()
+	r.NoError(err)
+
+	counts := make(map[string]uint64)
+	for _, mf := range mfs {
+		if mf.GetName() != "clamav_clamd_probe_latency_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			r.Len(m.GetHistogram().GetBucket(), 2)
+			counts[m.GetLabel()[0].GetValue()] = m.GetHistogram().GetSampleCount()
+		}
+	}
+	// the scrape itself has probed once more
+	r.Equal(map[string]uint64{"version": 4, "stats": 4, "eicar": 4}, counts)
+}
+
+func TestClamDCheckerVerdicts(t *testing.T) {
+	r := require.New(t)
+	f := newFakeClamD(t)
+	defer f.Close()
+
+	c := NewClamDChecker("", ClamDOptions{URL: f.URL()})
+	// every scrape probes once
+	gatherMetrics(t, c, "probe")
+	values := gatherMetrics(t, c, "probe")
+	r.Equal(2.0, values["clamav_clamd_scan_probes_total/eicar"])
+	r.Equal(2.0, values["clamav_clamd_scan_detections_total/eicar"])
+	r.Equal(0.0, values["clamav_clamd_scan_misses_total/eicar"])
+	r.Equal(0.0, values["clamav_clamd_scan_errors_total/eicar"])
+	r.True(values["clamav_clamd_scan_verdict_change_timestamp_seconds/eicar"] > 0)
+}
+
+func TestClamDCheckerStatsParseErrors(t *testing.T) {
+	r := require.New(t)
+	l, buf, _ := newTestLogger(t, LogOptions{})
+	defer func(orig *structuredLogger) { logger = orig }(logger)
+	logger = l
+
+	f := newFakeClamD(t)
+	defer f.Close()
+	c := NewClamDChecker("", ClamDOptions{URL: f.URL()})
+
+	var classes []string
+	for _, memstats := range []string{"heap 9.082X", "heap 9.082X", "heap 9.1X"} {
+		f.mu.Lock()
+		f.stats = strings.Replace(fakeClamDStats, "heap 9.082M", memstats, 1)
+		f.mu.Unlock()
+
+		cl, err := c.connect(context.Background())
+		r.NoError(err)
+		_, err = c.collectStats(cl)
+		cl.Close()
+		r.True(errors.Is(err, errClamDStatsParse), "%v", err)
+		classes = append(classes, errorClass(err))
+	}
+	// the probe error stays the same, the raw line is logged on changes
+	r.Equal([]string{classes[0], classes[0], classes[0]}, classes)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	r.Len(lines, 2)
+	r.Contains(lines[0], "heap 9.082X")
+	r.Contains(lines[1], "heap 9.1X")
+}
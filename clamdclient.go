@@ -0,0 +1,412 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// clamdChunkSize is the size of the chunks sent by INSTREAM, it must be
+	// less than the StreamMaxLength of clamd.
+	clamdChunkSize = 64 * 1024
+)
+
+var (
+	errClamDUnknownCommand    = errors.New("unknown command")
+	errClamDSizeLimitExceeded = errors.New("size limit exceeded")
+	errClamDSessionClosed     = errors.New("clamd session has been closed")
+)
+
+// clamdError is an error reply of clamd to a command. If the reply is known,
+// it wraps one of the errClamD* errors.
+type clamdError struct {
+	cmd   string
+	reply string
+	err   error
+}
+
+func (e *clamdError) Error() string {
+	return fmt.Sprintf("clamd %s failed: %s", e.cmd, e.reply)
+}
+
+func (e *clamdError) Unwrap() error {
+	return e.err
+}
+
+// checkClamDReply returns a clamdError if reply is an error reply.
+func checkClamDReply(cmd, reply string) error {
+	switch {
+	case reply == "UNKNOWN COMMAND":
+		return &clamdError{cmd, reply, errClamDUnknownCommand}
+	case strings.HasPrefix(reply, "INSTREAM size limit exceeded"):
+		return &clamdError{cmd, reply, errClamDSizeLimitExceeded}
+	case strings.HasSuffix(reply, " ERROR"):
+		return &clamdError{cmd, reply, nil}
+	}
+	return nil
+}
+
+// clamdScanResult is the result of scanning a stream.
+type clamdScanResult struct {
+	Found     bool
+	Signature string
+}
+
+// clamdReply is a reply of clamd within a session.
+type clamdReply struct {
+	reply string
+	err   error
+}
+
+// clamdClient speaks the clamd protocol over a single connection. Without a
+// session clamd closes the connection after the first command, with
+// IDSESSION several commands can be sent over the same connection, even
+// concurrently.
+//
+// The client honours the connect and read timeouts as well as the deadline
+// of the context it was dialed with.
+type clamdClient struct {
+	conn        net.Conn
+	tls         *tlsState
+	r           *bufio.Reader
+	ctx         context.Context
+	readTimeout time.Duration
+	// delim terminates commands and replies, '\n' for n-prefixed or 0 for
+	// z-prefixed commands
+	delim byte
+
+	// wmu serialises writes, so that an INSTREAM is not interrupted by
+	// other commands of the same session
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	session bool
+	nextID  int
+	pending map[int]chan clamdReply
+	cmds    map[int]string
+	readErr error
+}
+
+// parseClamDURL returns the network and address of a clamd URL like
+// tcp://127.0.0.1:3310 or unix:///var/run/clamav/clamd.ctl. Anything else is
+// treated as path of a unix socket.
+func parseClamDURL(rawurl string) (network, address string, err error) {
+	var u *url.URL
+	if u, err = url.Parse(rawurl); err != nil {
+		return
+	}
+	switch u.Scheme {
+	case "tcp":
+		return "tcp", u.Host, nil
+	case "unix":
+		return "unix", u.Path, nil
+	default:
+		return "unix", rawurl, nil
+	}
+}
+
+// dialClamD connects to clamd, over TLS unless tlsOpts is nil. The commands
+// and replies are terminated by delim, see clamdClient.
+func dialClamD(ctx context.Context, rawurl string, delim byte, t Timeouts, tlsOpts *TLSOptions) (*clamdClient, error) {
+	network, address, err := parseClamDURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	conn, state, err := dialTLS(ctx, network, address, t, tlsOpts)
+	if err != nil {
+		return nil, err
+	}
+	cl := newClamDClient(ctx, conn, t.Read.Duration, delim)
+	cl.tls = state
+	return cl, nil
+}
+
+func newClamDClient(ctx context.Context, conn net.Conn, readTimeout time.Duration, delim byte) *clamdClient {
+	return &clamdClient{
+		conn:        conn,
+		r:           bufio.NewReader(conn),
+		ctx:         ctx,
+		readTimeout: readTimeout,
+		delim:       delim,
+	}
+}
+
+func (c *clamdClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *clamdClient) prefix() string {
+	if c.delim == '\n' {
+		return "n"
+	}
+	return "z"
+}
+
+func (c *clamdClient) write(b []byte) error {
+	if err := c.conn.SetWriteDeadline(deadline(c.ctx, c.readTimeout)); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *clamdClient) writeCommand(cmd string) error {
+	return c.write([]byte(c.prefix() + cmd + string(c.delim)))
+}
+
+// writeInstream sends data in chunks, followed by the zero length chunk which
+// terminates the stream.
+func (c *clamdClient) writeInstream(data []byte) error {
+	if err := c.writeCommand("INSTREAM"); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > clamdChunkSize {
+			n = clamdChunkSize
+		}
+		chunk := make([]byte, 4, 4+n)
+		binary.BigEndian.PutUint32(chunk, uint32(n))
+		chunk = append(chunk, data[:n]...)
+		if err := c.write(chunk); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return c.write([]byte{0, 0, 0, 0})
+}
+
+// readReply reads the reply to cmd. Only STATS replies with several lines,
+// which are terminated by END.
+func (c *clamdClient) readReply(cmd string) (string, error) {
+	line, err := c.r.ReadString(c.delim)
+	if err != nil {
+		return "", err
+	}
+	reply := strings.TrimRight(line, "\x00\r\n")
+	if cmd != "STATS" || c.delim != '\n' {
+		return reply, nil
+	}
+	lines := []string{reply}
+	for reply != "END" {
+		if line, err = c.r.ReadString(c.delim); err != nil {
+			return "", err
+		}
+		reply = strings.TrimRight(line, "\r\n")
+		lines = append(lines, reply)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// StartSession starts an IDSESSION, all further commands are sent over the
+// same connection until Close ends the session.
+func (c *clamdClient) StartSession() error {
+	if err := c.writeCommand("IDSESSION"); err != nil {
+		return err
+	}
+	var rd time.Time
+	if ctxDeadline, ok := c.ctx.Deadline(); ok {
+		rd = ctxDeadline
+	}
+	if err := c.conn.SetReadDeadline(rd); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.session = true
+	c.nextID = 1
+	c.pending = make(map[int]chan clamdReply)
+	c.cmds = make(map[int]string)
+	c.mu.Unlock()
+
+	go c.readSession()
+	return nil
+}
+
+// readSession dispatches the replies of a session to the pending commands
+// by their id.
+func (c *clamdClient) readSession() {
+	for {
+		line, err := c.r.ReadString(c.delim)
+		if err != nil {
+			c.closeSession(err)
+			return
+		}
+		reply := strings.TrimRight(line, "\x00\r\n")
+		i := strings.Index(reply, ": ")
+		if i < 0 {
+			// replies without an id are errors that end the session, e.g.
+			// a command which is not allowed within a session
+			c.closeSession(checkClamDReply("IDSESSION", reply))
+			return
+		}
+		id, err := strconv.Atoi(reply[:i])
+		if err != nil {
+			c.closeSession(fmt.Errorf("invalid clamd session reply %q", reply))
+			return
+		}
+		reply = reply[i+2:]
+
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		cmd := c.cmds[id]
+		delete(c.pending, id)
+		delete(c.cmds, id)
+		c.mu.Unlock()
+
+		if cmd == "STATS" && c.delim == '\n' {
+			rest, err := c.readReply("")
+			for err == nil && rest != "END" {
+				reply += "\n" + rest
+				rest, err = c.readReply("")
+			}
+			if err != nil {
+				c.closeSession(err)
+				return
+			}
+			reply += "\nEND"
+		}
+		if ok {
+			ch <- clamdReply{reply: reply}
+		}
+	}
+}
+
+func (c *clamdClient) closeSession(err error) {
+	if err == nil {
+		err = errClamDSessionClosed
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readErr = err
+	for id, ch := range c.pending {
+		ch <- clamdReply{err: err}
+		delete(c.pending, id)
+	}
+}
+
+// EndSession ends the session, clamd closes the connection afterwards.
+func (c *clamdClient) EndSession() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writeCommand("END")
+}
+
+// roundTrip sends a command by calling send and waits for its reply.
+func (c *clamdClient) roundTrip(cmd string, send func() error) (string, error) {
+	c.mu.Lock()
+	session := c.session
+	c.mu.Unlock()
+
+	if !session {
+		if err := send(); err != nil {
+			return "", err
+		}
+		if err := c.conn.SetReadDeadline(deadline(c.ctx, c.readTimeout)); err != nil {
+			return "", err
+		}
+		return c.readReply(cmd)
+	}
+
+	ch := make(chan clamdReply, 1)
+	c.wmu.Lock()
+	c.mu.Lock()
+	if c.readErr != nil {
+		err := c.readErr
+		c.mu.Unlock()
+		c.wmu.Unlock()
+		return "", err
+	}
+	id := c.nextID
+	c.nextID++
+	c.pending[id] = ch
+	c.cmds[id] = cmd
+	c.mu.Unlock()
+	err := send()
+	c.wmu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	t := time.NewTimer(c.readTimeout)
+	defer t.Stop()
+	select {
+	case r := <-ch:
+		return r.reply, r.err
+	case <-t.C:
+		return "", fmt.Errorf("clamd %s: %w", cmd, context.DeadlineExceeded)
+	case <-c.ctx.Done():
+		return "", fmt.Errorf("clamd %s: %w", cmd, c.ctx.Err())
+	}
+}
+
+// Command sends a simple command like PING or VERSION and returns the reply.
+func (c *clamdClient) Command(cmd string) (string, error) {
+	reply, err := c.roundTrip(cmd, func() error {
+		return c.writeCommand(cmd)
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := checkClamDReply(cmd, reply); err != nil {
+		return "", err
+	}
+	return reply, nil
+}
+
+func (c *clamdClient) Ping() error {
+	reply, err := c.Command("PING")
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("got invalid clamd PING reply %q", reply)
+	}
+	return nil
+}
+
+func (c *clamdClient) Version() (string, error) {
+	return c.Command("VERSION")
+}
+
+// Stats returns the raw STATS reply, including the terminating END line.
+func (c *clamdClient) Stats() (string, error) {
+	return c.Command("STATS")
+}
+
+// Instream scans data of arbitrary size.
+func (c *clamdClient) Instream(data []byte) (res clamdScanResult, err error) {
+	var reply string
+	reply, err = c.roundTrip("INSTREAM", func() error {
+		return c.writeInstream(data)
+	})
+	if err != nil {
+		return
+	}
+	if err = checkClamDReply("INSTREAM", reply); err != nil {
+		return
+	}
+
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+	case strings.HasSuffix(reply, " FOUND"):
+		res.Found = true
+		res.Signature = strings.TrimSuffix(reply, " FOUND")
+	default:
+		err = fmt.Errorf("got invalid clamd INSTREAM reply %q", reply)
+	}
+	return
+}
@@ -0,0 +1,363 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const fakeClamDStats = `POOLS: 1
+
+STATE: VALID PRIMARY
+THREADS: live 1  idle 0 max 12 idle-timeout 30
+QUEUE: 0 items
+	STATS 0.000394
+
+MEMSTATS: heap 9.082M mmap 0.000M used 6.902M free 2.184M releasable 0.129M pools 1 pools_used 565.979M pools_total 565.999M
+END`
+
+// fakeClamD implements the parts of the clamd protocol which are used by the
+// exporter.
+type fakeClamD struct {
+	l             net.Listener
+	maxStreamSize int
+	stats         string
+
+	mu          sync.Mutex
+	connections int
+	chunks      int
+	reordered   int
+}
+
+func newFakeClamD(t *testing.T) *fakeClamD {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return serveFakeClamD(l)
+}
+
+// serveFakeClamD accepts connections on l, e.g. a TLS listener.
+func serveFakeClamD(l net.Listener) *fakeClamD {
+	f := &fakeClamD{l: l, maxStreamSize: 1 << 20, stats: fakeClamDStats}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.connections++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeClamD) Close() error {
+	return f.l.Close()
+}
+
+func (f *fakeClamD) URL() string {
+	return "tcp://" + f.l.Addr().String()
+}
+
+func (f *fakeClamD) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := &fakeClamDSessionWriter{conn: conn, f: f}
+	defer w.flush()
+
+	session := false
+	id := 0
+	for {
+		prefix, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		var delim byte
+		switch prefix {
+		case 'z':
+			delim = 0
+		case 'n':
+			delim = '\n'
+		default:
+			return
+		}
+		cmd, err := r.ReadString(delim)
+		if err != nil {
+			return
+		}
+		cmd = strings.TrimSuffix(cmd, string(delim))
+
+		var reply string
+		switch cmd {
+		case "IDSESSION":
+			session = true
+			continue
+		case "END":
+			return
+		case "PING":
+			reply = "PONG"
+		case "VERSION":
+			reply = "ClamAV 0.102.1/25701/Mon Jan 20 12:41:43 2020"
+		case "STATS":
+			f.mu.Lock()
+			reply = f.stats
+			f.mu.Unlock()
+		case "INSTREAM":
+			reply = f.instream(r)
+		default:
+			reply = "UNKNOWN COMMAND"
+		}
+
+		if !session {
+			conn.Write([]byte(reply + string(delim)))
+			return
+		}
+		id++
+		if err := w.write([]byte(fmt.Sprintf("%d: %s%c", id, reply, delim))); err != nil {
+			return
+		}
+		if strings.HasSuffix(reply, "ERROR") {
+			return
+		}
+	}
+}
+
+// fakeClamDSessionWriter swaps the replies of every two commands of a
+// session, like clamd does when a later command finishes first. A reply
+// which has no successor is sent after a short delay.
+type fakeClamDSessionWriter struct {
+	conn net.Conn
+	f    *fakeClamD
+
+	mu    sync.Mutex
+	held  []byte
+	timer *time.Timer
+}
+
+func (w *fakeClamDSessionWriter) write(reply []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.held == nil {
+		w.held = reply
+		w.timer = time.AfterFunc(20*time.Millisecond, w.flush)
+		return nil
+	}
+	w.timer.Stop()
+	held := w.held
+	w.held = nil
+	w.f.mu.Lock()
+	w.f.reordered++
+	w.f.mu.Unlock()
+	_, err := w.conn.Write(append(reply, held...))
+	return err
+}
+
+func (w *fakeClamDSessionWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.held != nil {
+		w.conn.Write(w.held)
+		w.held = nil
+	}
+}
+
+func (f *fakeClamD) instream(r io.Reader) string {
+	f.mu.Lock()
+	maxStreamSize := f.maxStreamSize
+	f.mu.Unlock()
+
+	var data []byte
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return "stream: read error ERROR"
+		}
+		if size == 0 {
+			break
+		}
+		if len(data)+int(size) > maxStreamSize {
+			return "INSTREAM size limit exceeded. ERROR"
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return "stream: read error ERROR"
+		}
+		data = append(data, chunk...)
+
+		f.mu.Lock()
+		f.chunks++
+		f.mu.Unlock()
+	}
+	if bytes.Contains(data, eicar) {
+		return "stream: Eicar-Test-Signature FOUND"
+	}
+	return "stream: OK"
+}
+
+func (f *fakeClamD) counters() (connections, chunks int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connections, f.chunks
+}
+
+func dialFakeClamD(t *testing.T, f *fakeClamD, delim byte) *clamdClient {
+	cl, err := dialClamD(context.Background(), f.URL(), delim, Timeouts{}.withDefaults(), nil)
+	require.NoError(t, err)
+	return cl
+}
+
+func TestClamDClientCommands(t *testing.T) {
+	f := newFakeClamD(t)
+	defer f.Close()
+
+	for _, delim := range []byte{0, '\n'} {
+		r := require.New(t)
+
+		cl := dialFakeClamD(t, f, delim)
+		r.NoError(cl.Ping())
+		cl.Close()
+
+		cl = dialFakeClamD(t, f, delim)
+		v, err := cl.Version()
+		r.NoError(err)
+		r.Equal("ClamAV 0.102.1/25701/Mon Jan 20 12:41:43 2020", v)
+		cl.Close()
+
+		// the reply to STATS spans several lines up to END
+		cl = dialFakeClamD(t, f, delim)
+		stats, err := cl.Stats()
+		r.NoError(err)
+		r.Equal(fakeClamDStats, stats)
+		cl.Close()
+
+		cl = dialFakeClamD(t, f, delim)
+		_, err = cl.Command("FROBNICATE")
+		r.True(errors.Is(err, errClamDUnknownCommand), "%v", err)
+		cl.Close()
+	}
+}
+
+func TestClamDClientInstream(t *testing.T) {
+	r := require.New(t)
+	f := newFakeClamD(t)
+	defer f.Close()
+
+	cl := dialFakeClamD(t, f, 0)
+	res, err := cl.Instream([]byte("hello"))
+	r.NoError(err)
+	r.False(res.Found)
+	cl.Close()
+
+	// larger than a single chunk, the signature is at the very end
+	data := append(bytes.Repeat([]byte{'x'}, 3*clamdChunkSize), eicar...)
+	cl = dialFakeClamD(t, f, 0)
+	res, err = cl.Instream(data)
+	r.NoError(err)
+	r.True(res.Found)
+	r.Equal("Eicar-Test-Signature", res.Signature)
+	_, chunks := f.counters()
+	r.Equal(5, chunks)
+	cl.Close()
+
+	f.mu.Lock()
+	f.maxStreamSize = clamdChunkSize
+	f.mu.Unlock()
+	cl = dialFakeClamD(t, f, 0)
+	_, err = cl.Instream(data)
+	r.True(errors.Is(err, errClamDSizeLimitExceeded), "%v", err)
+	cl.Close()
+}
+
+func TestClamDClientSession(t *testing.T) {
+	for _, delim := range []byte{0, '\n'} {
+		r := require.New(t)
+		f := newFakeClamD(t)
+
+		cl := dialFakeClamD(t, f, delim)
+		r.NoError(cl.StartSession())
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(3)
+			go func() {
+				defer wg.Done()
+				v, err := cl.Version()
+				r.NoError(err)
+				r.Equal("ClamAV 0.102.1/25701/Mon Jan 20 12:41:43 2020", v)
+			}()
+			go func() {
+				defer wg.Done()
+				stats, err := cl.Stats()
+				r.NoError(err)
+				r.Equal(fakeClamDStats, stats)
+			}()
+			go func() {
+				defer wg.Done()
+				res, err := cl.Instream(eicar)
+				r.NoError(err)
+				r.True(res.Found)
+			}()
+		}
+		wg.Wait()
+		r.NoError(cl.EndSession())
+		cl.Close()
+
+		connections, _ := f.counters()
+		r.Equal(1, connections)
+		f.mu.Lock()
+		r.NotZero(f.reordered, "no replies have been sent out of order")
+		f.mu.Unlock()
+		f.Close()
+	}
+}
+
+func TestClamDCheckerCommandPrefix(t *testing.T) {
+	r := require.New(t)
+	f := newFakeClamD(t)
+	defer f.Close()
+
+	r.Error(ClamDOptions{CommandPrefix: "x"}.validate())
+	opts := ClamDOptions{URL: f.URL(), CommandPrefix: "n"}
+	r.NoError(opts.validate())
+	values := gatherMetrics(t, NewClamDChecker("", opts))
+	r.Equal(1.0, values["clamav_clamd_up"])
+	r.Equal(1.0, values["clamav_clamd_stats_up"])
+	r.Equal(1.0, values["clamav_clamd_eicar_detected"])
+}
+
+func TestClamDCheckerProbe(t *testing.T) {
+	r := require.New(t)
+	f := newFakeClamD(t)
+	defer f.Close()
+
+	c := NewClamDChecker("", ClamDOptions{URL: f.URL()})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res := c.probe(ctx)
+	for _, p := range res.probes {
+		r.NoError(p.err, p.name)
+	}
+	r.Equal("0.102.1", res.version)
+	r.Equal(25701.0, res.dbVersion)
+	r.Equal(1.0, res.stats.Threads.Live)
+	r.Equal(12.0, res.stats.Threads.Max)
+	r.Equal(1, res.eicarDetected)
+	connections, _ := f.counters()
+	r.Equal(1, connections)
+}
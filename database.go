@@ -0,0 +1,249 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	cvdHeaderSize      = 512
+	cvdBuildTimeFormat = "02 Jan 2006 15-04 -0700"
+)
+
+var (
+	defaultDatabases = []string{"main", "daily", "bytecode"}
+)
+
+type DatabaseOptions struct {
+	Dir       string   `json:"dir"`
+	Databases []string `json:"databases"`
+}
+
+// cvdHeader is the header of a ClamAV database file (.cvd or .cld), e.g.
+//
+//	ClamAV-VDB:20 Jan 2020 07-41 -0500:25701:2159573:63:<md5>:<dsig>:raynman:1579524103
+type cvdHeader struct {
+	BuildTime          time.Time
+	Version            int
+	Signatures         int
+	FunctionalityLevel int
+	MD5                string
+	Builder            string
+}
+
+func parseCVDHeader(header []byte) (h cvdHeader, err error) {
+	f := strings.Split(strings.TrimRight(string(header), " \x00"), ":")
+	if len(f) < 8 || f[0] != "ClamAV-VDB" {
+		err = errors.New("invalid database header")
+		return
+	}
+	// newer databases contain the build time as unix epoch as well, which
+	// is more precise than the formatted time
+	if len(f) >= 9 {
+		var stime int64
+		if stime, err = strconv.ParseInt(f[8], 10, 64); err == nil {
+			h.BuildTime = time.Unix(stime, 0)
+		}
+	}
+	if h.BuildTime.IsZero() {
+		if h.BuildTime, err = time.Parse(cvdBuildTimeFormat, f[1]); err != nil {
+			err = fmt.Errorf("invalid database build time %q: %v", f[1], err)
+			return
+		}
+	}
+	if h.Version, err = strconv.Atoi(f[2]); err != nil {
+		err = fmt.Errorf("invalid database version %q: %v", f[2], err)
+		return
+	}
+	if h.Signatures, err = strconv.Atoi(f[3]); err != nil {
+		err = fmt.Errorf("invalid database signature count %q: %v", f[3], err)
+		return
+	}
+	if h.FunctionalityLevel, err = strconv.Atoi(f[4]); err != nil {
+		err = fmt.Errorf("invalid database functionality level %q: %v", f[4], err)
+		return
+	}
+	h.MD5 = f[5]
+	h.Builder = f[7]
+	return
+}
+
+func readCVDHeader(path string) (h cvdHeader, err error) {
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+
+	header := make([]byte, cvdHeaderSize)
+	if _, err = io.ReadFull(f, header); err != nil {
+		err = fmt.Errorf("failed to read database header of %q: %v", path, err)
+		return
+	}
+	if h, err = parseCVDHeader(header); err != nil {
+		err = fmt.Errorf("%s: %v", path, err)
+	}
+	return
+}
+
+// findDatabase reads the header of the database name (e.g. daily) in dir. If
+// both a .cvd and a .cld file exist, the one with the higher version is used,
+// like clamd does.
+func findDatabase(dir, name string) (h cvdHeader, path string, err error) {
+	found := false
+	for _, ext := range []string{".cvd", ".cld"} {
+		p := filepath.Join(dir, name+ext)
+		if _, statErr := os.Stat(p); os.IsNotExist(statErr) {
+			continue
+		}
+		header, readErr := readCVDHeader(p)
+		if readErr != nil {
+			err = readErr
+			continue
+		}
+		if !found || header.Version > h.Version {
+			h, path, found = header, p, true
+		}
+	}
+	if found {
+		err = nil
+	} else if err == nil {
+		err = fmt.Errorf("database %s not found in %q", name, dir)
+	}
+	return
+}
+
+type DatabaseChecker struct {
+	name string
+	opts DatabaseOptions
+
+	promDatabaseUp                 *prometheus.Desc
+	promDatabaseInfo               *prometheus.Desc
+	promDatabaseVersion            *prometheus.Desc
+	promDatabaseSignatures         *prometheus.Desc
+	promDatabaseFunctionalityLevel *prometheus.Desc
+	promDatabaseBuildTime          *prometheus.Desc
+}
+
+func NewDatabaseChecker(name string, opts DatabaseOptions) *DatabaseChecker {
+	if opts.Dir == "" {
+		opts.Dir = "/var/lib/clamav"
+	}
+	if len(opts.Databases) == 0 {
+		opts.Databases = defaultDatabases
+	}
+	constLabels := instanceLabels(name)
+	return &DatabaseChecker{
+		name: name,
+		opts: opts,
+		promDatabaseUp: prometheus.NewDesc(
+			"clamav_database_up",
+			"database file has been found and its header could be read",
+			[]string{"database"},
+			constLabels),
+		promDatabaseInfo: prometheus.NewDesc(
+			"clamav_database_info",
+			"file and builder of the database",
+			[]string{"database", "file", "builder"},
+			constLabels),
+		promDatabaseVersion: prometheus.NewDesc(
+			"clamav_database_version",
+			"version of the database",
+			[]string{"database"},
+			constLabels),
+		promDatabaseSignatures: prometheus.NewDesc(
+			"clamav_database_signatures",
+			"number of signatures in the database",
+			[]string{"database"},
+			constLabels),
+		promDatabaseFunctionalityLevel: prometheus.NewDesc(
+			"clamav_database_functionality_level",
+			"minimum functionality level of the engine required by the database",
+			[]string{"database"},
+			constLabels),
+		promDatabaseBuildTime: prometheus.NewDesc(
+			"clamav_database_build_timestamp_seconds",
+			"unix epoch timestamp of the database build time",
+			[]string{"database"},
+			constLabels),
+	}
+}
+
+func (c *DatabaseChecker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.promDatabaseUp
+	ch <- c.promDatabaseInfo
+	ch <- c.promDatabaseVersion
+	ch <- c.promDatabaseSignatures
+	ch <- c.promDatabaseFunctionalityLevel
+	ch <- c.promDatabaseBuildTime
+}
+
+func (c *DatabaseChecker) Collect(ch chan<- prometheus.Metric) {
+	c.CollectContext(context.Background(), ch)
+}
+
+// CollectContext reads the database headers, which are local files, so ctx is
+// not used.
+func (c *DatabaseChecker) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	for _, db := range c.opts.Databases {
+		h, path, err := findDatabase(c.opts.Dir, db)
+		ch <- prometheus.MustNewConstMetric(
+			c.promDatabaseUp,
+			prometheus.GaugeValue,
+			boolToFloat(err == nil),
+			db,
+		)
+		if err != nil {
+			logger.Limited(levelWarn, err.Error(), "failed to read database",
+				"instance", c.name,
+				"database", db,
+				"err", err)
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			c.promDatabaseInfo,
+			prometheus.GaugeValue,
+			1,
+			db,
+			filepath.Base(path),
+			h.Builder,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.promDatabaseVersion,
+			prometheus.GaugeValue,
+			float64(h.Version),
+			db,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.promDatabaseSignatures,
+			prometheus.GaugeValue,
+			float64(h.Signatures),
+			db,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.promDatabaseFunctionalityLevel,
+			prometheus.GaugeValue,
+			float64(h.FunctionalityLevel),
+			db,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.promDatabaseBuildTime,
+			prometheus.GaugeValue,
+			float64(h.BuildTime.Unix()),
+			db,
+		)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestDatabase(t *testing.T, path, header string) {
+	data := append([]byte(header), bytes.Repeat([]byte{' '}, cvdHeaderSize-len(header))...)
+	data = append(data, "compressed database follows"...)
+	require.NoError(t, ioutil.WriteFile(path, data, 0644))
+}
+
+func TestParseCVDHeader(t *testing.T) {
+	r := require.New(t)
+
+	h, err := parseCVDHeader([]byte("ClamAV-VDB:20 Jan 2020 07-41 -0500:25701:2159573:63:0f7d7c4d3bd0b3ed9c28d5d3a5f5cd1b:sig:raynman:1579524103"))
+	r.NoError(err)
+	r.Equal(25701, h.Version)
+	r.Equal(2159573, h.Signatures)
+	r.Equal(63, h.FunctionalityLevel)
+	r.Equal("raynman", h.Builder)
+	r.Equal(int64(1579524103), h.BuildTime.Unix())
+
+	// old databases lack the build time as unix epoch
+	h, err = parseCVDHeader([]byte("ClamAV-VDB:16 Nov 2009 04-32 -0500:51:545035:42:60c4e7fbd8bee9aa8bbe9f1c62e33ba4:sig:sven"))
+	r.NoError(err)
+	r.Equal(51, h.Version)
+	r.Equal(int64(1258363920), h.BuildTime.Unix())
+
+	_, err = parseCVDHeader([]byte("PK\x03\x04 not a database"))
+	r.Error(err)
+}
+
+func TestFindDatabase(t *testing.T) {
+	r := require.New(t)
+
+	dir, err := ioutil.TempDir("", "clamav-exporter-test")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+
+	writeTestDatabase(t, filepath.Join(dir, "main.cvd"), "ClamAV-VDB:25 Nov 2019 10-53 -0500:59:4564902:60:md5:sig:sigmgr:1574697240")
+	writeTestDatabase(t, filepath.Join(dir, "daily.cvd"), "ClamAV-VDB:19 Jan 2020 07-41 -0500:25700:2159000:63:md5:sig:raynman:1579437660")
+	writeTestDatabase(t, filepath.Join(dir, "daily.cld"), "ClamAV-VDB:20 Jan 2020 07-41 -0500:25701:2159573:63:md5:sig:raynman:1579524103")
+	r.NoError(ioutil.WriteFile(filepath.Join(dir, "bytecode.cvd"), []byte("truncated"), 0644))
+
+	h, path, err := findDatabase(dir, "main")
+	r.NoError(err)
+	r.Equal(59, h.Version)
+	r.Equal(filepath.Join(dir, "main.cvd"), path)
+
+	h, path, err = findDatabase(dir, "daily")
+	r.NoError(err)
+	r.Equal(25701, h.Version)
+	r.Equal(filepath.Join(dir, "daily.cld"), path)
+
+	_, _, err = findDatabase(dir, "bytecode")
+	r.Error(err)
+
+	_, _, err = findDatabase(dir, "safebrowsing")
+	r.Error(err)
+}
+
+func TestClamDReloadPending(t *testing.T) {
+	r := require.New(t)
+	f := newFakeClamD(t)
+	defer f.Close()
+
+	dir, err := ioutil.TempDir("", "clamav-exporter-test")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+
+	c := NewClamDChecker("", ClamDOptions{URL: f.URL(), DatabaseDir: dir})
+
+	// clamd reports daily version 25701
+	writeTestDatabase(t, filepath.Join(dir, "daily.cld"), "ClamAV-VDB:20 Jan 2020 07-41 -0500:25701:2159573:63:md5:sig:raynman:1579524103")
+	res := c.probe(context.Background())
+	r.NoError(res.diskErr)
+	r.Equal(25701.0, res.diskVersion)
+	r.True(res.reloadPendingSince.IsZero())
+
+	writeTestDatabase(t, filepath.Join(dir, "daily.cld"), "ClamAV-VDB:21 Jan 2020 07-41 -0500:25702:2159800:63:md5:sig:raynman:1579610503")
+	res = c.probe(context.Background())
+	r.Equal(25702.0, res.diskVersion)
+	r.False(res.reloadPendingSince.IsZero())
+	since := res.reloadPendingSince
+
+	res = c.probe(context.Background())
+	r.Equal(since, res.reloadPendingSince)
+
+	writeTestDatabase(t, filepath.Join(dir, "daily.cld"), "ClamAV-VDB:20 Jan 2020 07-41 -0500:25701:2159573:63:md5:sig:raynman:1579524103")
+	res = c.probe(context.Background())
+	r.True(res.reloadPendingSince.IsZero())
+}
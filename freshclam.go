@@ -0,0 +1,382 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// freshclamLogTimeFormat is the ctime(3) format which prefixes every
+	// line of the freshclam log if LogTime is enabled
+	freshclamLogTimeFormat = "Mon Jan _2 15:04:05 2006"
+	// freshclamDatSize is the size of freshclam_dat_v1_t on 64bit platforms,
+	// the retry after time_t follows the uuid and 7 bytes of padding
+	freshclamDatSize             = 56
+	freshclamDatRetryAfterOffset = 48
+	freshclamDatSupportedVersion = 1
+)
+
+const (
+	freshclamFailureMirrorCooldown = "mirror_cooldown"
+	freshclamFailureRateLimit      = "rate_limit"
+	freshclamFailureSignature      = "signature_verification"
+	freshclamFailureOutdated       = "outdated_engine"
+)
+
+var (
+	freshclamFailureTypes = []string{
+		freshclamFailureMirrorCooldown,
+		freshclamFailureRateLimit,
+		freshclamFailureSignature,
+		freshclamFailureOutdated,
+	}
+	freshclamVersionRe = regexp.MustCompile(`Local version: (\S+) Recommended version: (\S+)`)
+)
+
+type FreshclamOptions struct {
+	LogFile string `json:"log_file"`
+	DatFile string `json:"dat_file"`
+	// Timezone freshclam is running in, the log contains local time
+	Timezone Location `json:"timezone"`
+}
+
+// freshclamDat is the state file of freshclam, which contains the uuid sent
+// in the user agent and when the CDN may be contacted again after it replied
+// with 429 or 403.
+type freshclamDat struct {
+	Version    uint32
+	UUID       string
+	RetryAfter time.Time
+}
+
+func parseFreshclamDat(b []byte) (d freshclamDat, err error) {
+	if len(b) < freshclamDatSize {
+		err = fmt.Errorf("freshclam.dat is too short (%d bytes)", len(b))
+		return
+	}
+	d.Version = binary.LittleEndian.Uint32(b)
+	if d.Version != freshclamDatSupportedVersion {
+		err = fmt.Errorf("unsupported freshclam.dat version %d", d.Version)
+		return
+	}
+	d.UUID = strings.TrimRight(string(b[4:freshclamDatRetryAfterOffset]), "\x00")
+	if retryAfter := int64(binary.LittleEndian.Uint64(b[freshclamDatRetryAfterOffset:])); retryAfter > 0 {
+		d.RetryAfter = time.Unix(retryAfter, 0)
+	}
+	return
+}
+
+func readFreshclamDat(path string) (freshclamDat, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return freshclamDat{}, err
+	}
+	d, err := parseFreshclamDat(b)
+	if err != nil {
+		return d, fmt.Errorf("%s: %v", path, err)
+	}
+	return d, nil
+}
+
+// freshclamLogState is the update health derived from the freshclam log. An
+// update attempt starts with "ClamAV update process started", it is
+// successful if every database is up to date or has been updated and no
+// error has been logged.
+type freshclamLogState struct {
+	lastSuccess        time.Time
+	lastFailure        time.Time
+	localVersion       string
+	recommendedVersion string
+	failures           map[string]int
+
+	attemptFailed      bool
+	attemptHasVersions bool
+	successBefore      time.Time
+}
+
+// parseLine updates the state by a single log line, now is used for lines
+// without a timestamp.
+func (s *freshclamLogState) parseLine(line string, loc *time.Location, now time.Time) {
+	ts := now
+	if i := strings.Index(line, " -> "); i >= 0 {
+		if t, err := time.ParseInLocation(freshclamLogTimeFormat, line[:i], loc); err == nil {
+			ts = t
+			line = line[i+4:]
+		}
+	}
+
+	isError := false
+	switch {
+	case strings.HasPrefix(line, "ERROR: "):
+		isError = true
+		line = strings.TrimPrefix(line, "ERROR: ")
+	case strings.HasPrefix(line, "WARNING: "):
+		line = strings.TrimPrefix(line, "WARNING: ")
+	}
+
+	switch {
+	case strings.HasPrefix(line, "ClamAV update process started"):
+		s.attemptFailed = false
+		s.attemptHasVersions = false
+		s.successBefore = s.lastSuccess
+	case strings.Contains(line, "database is up to date (version:"),
+		strings.Contains(line, " updated (version:"),
+		strings.HasPrefix(line, "Database updated ("):
+		if !s.attemptFailed {
+			s.lastSuccess = ts
+		}
+		// freshclam only reports the recommended version if the engine is
+		// outdated, a successful attempt without it means it is up to date
+		if !s.attemptHasVersions {
+			s.localVersion, s.recommendedVersion = "", ""
+		}
+	case strings.Contains(line, "still in cool-down"),
+		strings.HasPrefix(line, "Ignoring mirror"):
+		s.failures[freshclamFailureMirrorCooldown]++
+		isError = true
+	case strings.Contains(line, "received error code 429") && !strings.Contains(line, "previously"):
+		s.failures[freshclamFailureRateLimit]++
+		isError = true
+	case strings.Contains(line, "Can't verify database"),
+		strings.HasPrefix(line, "Verification: "):
+		s.failures[freshclamFailureSignature]++
+		isError = true
+	case strings.Contains(line, "installation is OUTDATED"):
+		s.failures[freshclamFailureOutdated]++
+	default:
+		if m := freshclamVersionRe.FindStringSubmatch(line); m != nil {
+			s.localVersion, s.recommendedVersion = m[1], m[2]
+			s.attemptHasVersions = true
+		}
+	}
+
+	if isError {
+		// an error logged after some databases have been found up to date
+		// still fails the whole attempt
+		if !s.attemptFailed {
+			s.attemptFailed = true
+			s.lastSuccess = s.successBefore
+		}
+		s.lastFailure = ts
+	}
+}
+
+type FreshclamChecker struct {
+	name string
+	opts FreshclamOptions
+
+	// mu protects the position in the log file, which is read incrementally
+	// on every scrape, and the state derived from it
+	mu      sync.Mutex
+	logInfo os.FileInfo
+	offset  int64
+	state   freshclamLogState
+
+	promFreshclamLogUp              *prometheus.Desc
+	promFreshclamLastSuccess        *prometheus.Desc
+	promFreshclamLastFailure        *prometheus.Desc
+	promFreshclamFailures           *prometheus.CounterVec
+	promFreshclamRecommendedVersion *prometheus.Desc
+	promFreshclamDatUp              *prometheus.Desc
+	promFreshclamCooldownUntil      *prometheus.Desc
+}
+
+func NewFreshclamChecker(name string, opts FreshclamOptions) *FreshclamChecker {
+	if opts.LogFile == "" {
+		opts.LogFile = "/var/log/clamav/freshclam.log"
+	}
+	if opts.DatFile == "" {
+		opts.DatFile = "/var/lib/clamav/freshclam.dat"
+	}
+	constLabels := instanceLabels(name)
+	c := &FreshclamChecker{
+		name:  name,
+		opts:  opts,
+		state: freshclamLogState{failures: make(map[string]int)},
+		promFreshclamLogUp: prometheus.NewDesc(
+			"clamav_freshclam_log_up",
+			"freshclam log file could be read",
+			[]string{},
+			constLabels),
+		promFreshclamLastSuccess: prometheus.NewDesc(
+			"clamav_freshclam_last_success_timestamp_seconds",
+			"unix epoch timestamp of the last successful database update",
+			[]string{},
+			constLabels),
+		promFreshclamLastFailure: prometheus.NewDesc(
+			"clamav_freshclam_last_failure_timestamp_seconds",
+			"unix epoch timestamp of the last failed database update",
+			[]string{},
+			constLabels),
+		promFreshclamFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "clamav_freshclam_failures_total",
+			Help:        "number of freshclam failures and warnings found in the log by type",
+			ConstLabels: constLabels,
+		}, []string{"type"}),
+		promFreshclamRecommendedVersion: prometheus.NewDesc(
+			"clamav_freshclam_recommended_version_info",
+			"local and recommended ClamAV version, if freshclam reported an outdated engine",
+			[]string{"local_version", "recommended_version"},
+			constLabels),
+		promFreshclamDatUp: prometheus.NewDesc(
+			"clamav_freshclam_dat_up",
+			"freshclam.dat could be read",
+			[]string{},
+			constLabels),
+		promFreshclamCooldownUntil: prometheus.NewDesc(
+			"clamav_freshclam_cooldown_until_timestamp_seconds",
+			"unix epoch timestamp until which freshclam does not contact the CDN, 0 if it is not in cool-down",
+			[]string{},
+			constLabels),
+	}
+	for _, typ := range freshclamFailureTypes {
+		c.promFreshclamFailures.WithLabelValues(typ)
+	}
+	return c
+}
+
+func (c *FreshclamChecker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.promFreshclamLogUp
+	ch <- c.promFreshclamLastSuccess
+	ch <- c.promFreshclamLastFailure
+	c.promFreshclamFailures.Describe(ch)
+	ch <- c.promFreshclamRecommendedVersion
+	ch <- c.promFreshclamDatUp
+	ch <- c.promFreshclamCooldownUntil
+}
+
+// readLog parses the lines appended to the log since the last call. If the
+// log has been truncated or rotated, it is read from the beginning. A
+// trailing incomplete line is left for the next call.
+func (c *FreshclamChecker) readLog() error {
+	f, err := os.Open(c.opts.LogFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if c.logInfo == nil || !os.SameFile(c.logInfo, fi) || fi.Size() < c.offset {
+		c.offset = 0
+	}
+	c.logInfo = fi
+	if _, err := f.Seek(c.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	loc := c.opts.Timezone.get()
+	now := time.Now()
+	before := make(map[string]int, len(c.state.failures))
+	for typ, n := range c.state.failures {
+		before[typ] = n
+	}
+	// the failures of the lines parsed so far are counted even if reading
+	// fails, they are part of the state the next call starts from
+	defer func() {
+		for typ, n := range c.state.failures {
+			if delta := n - before[typ]; delta > 0 {
+				c.promFreshclamFailures.WithLabelValues(typ).Add(float64(delta))
+			}
+		}
+	}()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+		c.offset += int64(len(line))
+		c.state.parseLine(strings.TrimRight(line, "\r\n"), loc, now)
+	}
+	return nil
+}
+
+func (c *FreshclamChecker) Collect(ch chan<- prometheus.Metric) {
+	c.CollectContext(context.Background(), ch)
+}
+
+// CollectContext reads local files only, so ctx is not used.
+func (c *FreshclamChecker) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.readLog()
+	if err != nil {
+		logger.Limited(levelWarn, err.Error(), "failed to read freshclam log",
+			"instance", c.name,
+			"err", err)
+	}
+	ch <- prometheus.MustNewConstMetric(
+		c.promFreshclamLogUp,
+		prometheus.GaugeValue,
+		boolToFloat(err == nil),
+	)
+	if !c.state.lastSuccess.IsZero() {
+		ch <- prometheus.MustNewConstMetric(
+			c.promFreshclamLastSuccess,
+			prometheus.GaugeValue,
+			float64(c.state.lastSuccess.Unix()),
+		)
+	}
+	if !c.state.lastFailure.IsZero() {
+		ch <- prometheus.MustNewConstMetric(
+			c.promFreshclamLastFailure,
+			prometheus.GaugeValue,
+			float64(c.state.lastFailure.Unix()),
+		)
+	}
+	c.promFreshclamFailures.Collect(ch)
+	if c.state.recommendedVersion != "" {
+		ch <- prometheus.MustNewConstMetric(
+			c.promFreshclamRecommendedVersion,
+			prometheus.GaugeValue,
+			1,
+			c.state.localVersion,
+			c.state.recommendedVersion,
+		)
+	}
+
+	dat, err := readFreshclamDat(c.opts.DatFile)
+	if err != nil {
+		logger.Limited(levelWarn, err.Error(), "failed to read freshclam.dat",
+			"instance", c.name,
+			"err", err)
+	}
+	ch <- prometheus.MustNewConstMetric(
+		c.promFreshclamDatUp,
+		prometheus.GaugeValue,
+		boolToFloat(err == nil),
+	)
+	if err == nil {
+		cooldownUntil := 0.0
+		if dat.RetryAfter.After(time.Now()) {
+			cooldownUntil = float64(dat.RetryAfter.Unix())
+		}
+		ch <- prometheus.MustNewConstMetric(
+			c.promFreshclamCooldownUntil,
+			prometheus.GaugeValue,
+			cooldownUntil,
+		)
+	}
+}
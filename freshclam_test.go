@@ -0,0 +1,135 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func makeFreshclamDat(version uint32, uuid string, retryAfter int64) []byte {
+	b := make([]byte, freshclamDatSize)
+	binary.LittleEndian.PutUint32(b, version)
+	copy(b[4:], uuid)
+	binary.LittleEndian.PutUint64(b[freshclamDatRetryAfterOffset:], uint64(retryAfter))
+	return b
+}
+
+func TestParseFreshclamDat(t *testing.T) {
+	r := require.New(t)
+
+	d, err := parseFreshclamDat(makeFreshclamDat(1, "b8d5f8a0-5e1c-4b4a-9f38-2f5c0a6f1d2e", 1579882788))
+	r.NoError(err)
+	r.Equal("b8d5f8a0-5e1c-4b4a-9f38-2f5c0a6f1d2e", d.UUID)
+	r.Equal(int64(1579882788), d.RetryAfter.Unix())
+
+	d, err = parseFreshclamDat(makeFreshclamDat(1, "b8d5f8a0-5e1c-4b4a-9f38-2f5c0a6f1d2e", 0))
+	r.NoError(err)
+	r.True(d.RetryAfter.IsZero())
+
+	_, err = parseFreshclamDat(makeFreshclamDat(2, "", 0))
+	r.Error(err)
+	_, err = parseFreshclamDat([]byte{1, 0, 0, 0})
+	r.Error(err)
+}
+
+func TestFreshclamLog(t *testing.T) {
+	r := require.New(t)
+
+	log, err := ioutil.ReadFile("testdata/freshclam-0.102.log")
+	r.NoError(err)
+
+	dir, err := ioutil.TempDir("", "clamav-exporter-test")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+
+	logFile := filepath.Join(dir, "freshclam.log")
+	c := NewFreshclamChecker("", FreshclamOptions{
+		LogFile:  logFile,
+		DatFile:  filepath.Join(dir, "freshclam.dat"),
+		Timezone: Location{time.UTC},
+	})
+
+	// the log is tailed, a partial last line is parsed once it is complete
+	half := len(log) / 2
+	r.NoError(ioutil.WriteFile(logFile, log[:half], 0644))
+	r.NoError(c.readLog())
+	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0644)
+	r.NoError(err)
+	_, err = f.Write(log[half:])
+	r.NoError(err)
+	r.NoError(f.Close())
+	r.NoError(c.readLog())
+
+	s := c.state
+	r.Equal(time.Date(2020, 2, 7, 11, 19, 52, 0, time.UTC), s.lastSuccess)
+	r.Equal(time.Date(2020, 2, 7, 10, 19, 49, 0, time.UTC), s.lastFailure)
+	r.Equal("0.102.1", s.localVersion)
+	r.Equal("0.102.2", s.recommendedVersion)
+	r.Equal(map[string]int{
+		freshclamFailureSignature: 1,
+		freshclamFailureOutdated:  3,
+	}, s.failures)
+
+	// after the log has been rotated, a successful update is found and the
+	// engine is no longer outdated
+	r.NoError(os.Remove(logFile))
+	r.NoError(ioutil.WriteFile(logFile, []byte(
+		"Sat Feb  8 09:19:47 2020 -> ClamAV update process started at Sat Feb  8 09:19:47 2020\n"+
+			"Sat Feb  8 09:19:48 2020 -> daily.cld database is up to date (version: 25720, sigs: 2173574, f-level: 63, builder: raynman)\n"), 0644))
+	r.NoError(c.readLog())
+	r.Equal(time.Date(2020, 2, 8, 9, 19, 48, 0, time.UTC), c.state.lastSuccess)
+	r.Equal("", c.state.recommendedVersion)
+	r.Equal(3, c.state.failures[freshclamFailureOutdated])
+}
+
+func TestFreshclamLogRateLimit(t *testing.T) {
+	r := require.New(t)
+
+	c := NewFreshclamChecker("", FreshclamOptions{
+		LogFile:  "testdata/freshclam-0.103-cdn.log",
+		Timezone: Location{time.UTC},
+	})
+	r.NoError(c.readLog())
+
+	s := c.state
+	r.True(s.lastSuccess.IsZero())
+	r.Equal(time.Date(2021, 11, 2, 13, 19, 47, 0, time.UTC), s.lastFailure)
+	r.Equal(map[string]int{
+		freshclamFailureMirrorCooldown: 1,
+		freshclamFailureRateLimit:      1,
+	}, s.failures)
+}
+
+func TestFreshclamCheckerGather(t *testing.T) {
+	r := require.New(t)
+
+	dir, err := ioutil.TempDir("", "clamav-exporter-test")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+
+	retryAfter := time.Now().Add(time.Hour).Unix()
+	datFile := filepath.Join(dir, "freshclam.dat")
+	r.NoError(ioutil.WriteFile(datFile, makeFreshclamDat(1, "b8d5f8a0-5e1c-4b4a-9f38-2f5c0a6f1d2e", retryAfter), 0644))
+
+	c := NewFreshclamChecker("mail", FreshclamOptions{
+		LogFile: "testdata/freshclam-0.102.log",
+		DatFile: datFile,
+	})
+	values := gatherMetrics(t, c, "type")
+	r.Equal(1.0, values["clamav_freshclam_log_up"])
+	r.Equal(1.0, values["clamav_freshclam_dat_up"])
+	r.Equal(float64(retryAfter), values["clamav_freshclam_cooldown_until_timestamp_seconds"])
+	r.Equal(3.0, values["clamav_freshclam_failures_total/outdated_engine"])
+	r.Equal(1.0, values["clamav_freshclam_failures_total/signature_verification"])
+	r.Equal(0.0, values["clamav_freshclam_failures_total/rate_limit"])
+	r.Equal(1.0, values["clamav_freshclam_recommended_version_info"])
+	r.Contains(values, "clamav_freshclam_last_success_timestamp_seconds")
+}
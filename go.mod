@@ -3,7 +3,6 @@ module github.com/mgit-at/clamav-exporter
 go 1.13
 
 require (
-	github.com/imgurbot12/clamd v0.0.0-20181005000138-6a19476e142c
 	github.com/prometheus/client_golang v1.3.0
 	github.com/shenwei356/util v0.0.0-20190523143900-f71ff373860c
 	github.com/stretchr/testify v1.3.0
@@ -1,45 +1,147 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
 	"net"
-	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/imgurbot12/clamd"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-var (
-	icapServerVersionRegexp   = regexp.MustCompile(`Server: C-ICAP/(.+?)\r\n`)
-	icapRespCodeRegexp        = regexp.MustCompile(`ICAP/1\.0 (\d+)`)
-	icapRespThreatFoundRegexp = regexp.MustCompile(`X-Infection-Found: .*Threat=(.*);`)
-)
-
 type IcapOptions struct {
 	Host    string `json:"host"`
 	Port    string `json:"port"`
 	Service string `json:"service"`
+	// Method is either RESPMOD (default), which scans a response as squid
+	// does for downloads, or REQMOD, which scans the body of a POST request
+	// like an upload
+	Method string `json:"method"`
+	// ContentType of the encapsulated HTTP message, application/octet-stream
+	// by default
+	ContentType string `json:"content_type"`
+	// Tests are scanned in addition to the EICAR and hello streams
+	Tests []IcapTestCase `json:"tests"`
+	// TLS enables ICAPS, e.g. on port 11344 of c-icap
+	TLS *TLSOptions `json:"tls"`
+	// Preview sends as many bytes as the service asks for in its OPTIONS
+	// response first and the rest only after 100 Continue, like squid does
+	Preview bool `json:"preview"`
+	// KeepAlive sends all requests of a scrape one after another over a
+	// persistent connection instead of a connection for each request
+	KeepAlive bool `json:"keep_alive"`
+
+	ProbeOptions
+}
+
+// IcapTestCase is a file which is scanned by the ICAP service on every probe
+// and compared to the expected verdict.
+type IcapTestCase struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	// Expect is either "clean" or "infected"
+	Expect string `json:"expect"`
+	// Signature is the expected name of the threat, if set
+	Signature string `json:"signature"`
+}
+
+func (o IcapOptions) validate() error {
+	switch strings.ToUpper(o.Method) {
+	case "", "RESPMOD", "REQMOD":
+	default:
+		return fmt.Errorf("unsupported ICAP method %q", o.Method)
+	}
+	if err := o.ProbeOptions.validate(); err != nil {
+		return err
+	}
+	names := map[string]bool{"eicar": true, "hello": true, "options": true}
+	for _, tc := range o.Tests {
+		if tc.Name == "" {
+			return fmt.Errorf("test case without name")
+		}
+		if names[tc.Name] {
+			return fmt.Errorf("duplicate test case %q", tc.Name)
+		}
+		names[tc.Name] = true
+		if tc.File == "" {
+			return fmt.Errorf("test case %q lacks a file", tc.Name)
+		}
+		switch tc.Expect {
+		case "clean":
+			if tc.Signature != "" {
+				return fmt.Errorf("test case %q expects a signature of a clean file", tc.Name)
+			}
+		case "infected":
+		default:
+			return fmt.Errorf("test case %q expects unknown verdict %q", tc.Name, tc.Expect)
+		}
+	}
+	if o.TLS != nil {
+		return o.TLS.validate()
+	}
+	return nil
 }
 
 type IcapChecker struct {
+	name string
 	opts IcapOptions
 
+	// mu protects the last result of background probes and the last ISTag
+	// of the service, to count its changes
+	mu    sync.Mutex
+	last  *icapResult
+	istag string
+	// preview is the Preview size of the last OPTIONS response, NaN if the
+	// service does not support previews; previewKnown is false until the
+	// first OPTIONS response has been read
+	preview      float64
+	previewKnown bool
+
+	promIcapOptionsStatusCode *prometheus.Desc
+	promIcapISTag             *prometheus.Desc
+	promIcapISTagChanges      prometheus.Counter
+	promIcapOptionsPreview    *prometheus.Desc
+	promIcapOptionsMaxConns   *prometheus.Desc
+	promIcapOptionsTTL        *prometheus.Desc
+	promIcapOptionsMethod     *prometheus.Desc
+	promIcapTLSHandshake      *prometheus.Desc
+	promIcapTLSCertExpiry     *prometheus.Desc
+	promIcapPath              *prometheus.Desc
+	promIcapPhase             *prometheus.Desc
+	promIcapRequestTime       *prometheus.Desc
+	promIcapConnReused        *prometheus.Desc
+	promIcapConnsOpened       *prometheus.Desc
+	promIcapConnReuseFailures *prometheus.Desc
+
+	promIcapTestPassed   *prometheus.Desc
+	promIcapTestDetected *prometheus.Desc
+	promIcapTestIcapCode *prometheus.Desc
+	promIcapTestThreat   *prometheus.Desc
+
 	promIcapUp                 *prometheus.Desc
 	promIcapEicarIcapCode      *prometheus.Desc
 	promIcapEicarDetected      *prometheus.Desc
 	promIcapEicarDetectionTime *prometheus.Desc
 	promIcapHelloOK            *prometheus.Desc
 	promIcapHelloOKTime        *prometheus.Desc
+	promIcapProbeTimeout       *prometheus.Desc
+	promIcapProbeDuration      *prometheus.Desc
+	promIcapProbeLatency       *prometheus.HistogramVec
+	verdicts                   *verdictTracker
+	promIcapLastProbeTime      *prometheus.Desc
+	promIcapProbeAge           *prometheus.Desc
 }
 
-func NewIcapChecker(opts IcapOptions) *IcapChecker {
+func NewIcapChecker(name string, opts IcapOptions) *IcapChecker {
 	if opts.Host == "" {
 		opts.Host = "localhost"
 	}
@@ -49,38 +151,169 @@ func NewIcapChecker(opts IcapOptions) *IcapChecker {
 	if opts.Service == "" {
 		opts.Service = "squidclamav?allow204=on&force=on&sizelimit=off&mode=simple"
 	}
+	if opts.Method == "" {
+		opts.Method = "RESPMOD"
+	}
+	opts.Method = strings.ToUpper(opts.Method)
+	if opts.ContentType == "" {
+		opts.ContentType = "application/octet-stream"
+	}
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	constLabels := instanceLabels(name)
+	scanProbes := []string{"eicar", "hello"}
+	for _, tc := range opts.Tests {
+		scanProbes = append(scanProbes, tc.Name)
+	}
 	return &IcapChecker{
+		name: name,
 		opts: opts,
 		promIcapUp: prometheus.NewDesc(
 			"clamav_icap_up",
 			"connection to clamd is successful",
 			[]string{"version"},
-			nil),
+			constLabels),
 		promIcapEicarIcapCode: prometheus.NewDesc(
 			"clamav_icap_eicar_icap_code",
 			"ICAP result code for eicar test stream",
 			[]string{},
-			nil),
+			constLabels),
 		promIcapEicarDetected: prometheus.NewDesc(
 			"clamav_icap_eicar_detected",
 			"successfully detected eicar test stream",
 			[]string{},
-			nil),
+			constLabels),
 		promIcapEicarDetectionTime: prometheus.NewDesc(
 			"clamav_icap_eicar_detection_time_seconds",
 			"eicar test stream detection time",
 			[]string{},
-			nil),
+			constLabels),
 		promIcapHelloOK: prometheus.NewDesc(
 			"clamav_icap_hello_ok",
 			"correctly identified hello as non-threatening",
 			[]string{},
-			nil),
+			constLabels),
 		promIcapHelloOKTime: prometheus.NewDesc(
 			"clamav_icap_hello_ok_time_seconds",
 			"unthreatening hello test stream detection time",
 			[]string{},
-			nil),
+			constLabels),
+		promIcapOptionsStatusCode: prometheus.NewDesc(
+			"clamav_icap_options_status_code",
+			"ICAP status code of the OPTIONS response",
+			[]string{},
+			constLabels),
+		promIcapISTag: prometheus.NewDesc(
+			"clamav_icap_istag_info",
+			"ISTag of the service, which changes e.g. when the signatures are reloaded",
+			[]string{"istag"},
+			constLabels),
+		promIcapISTagChanges: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "clamav_icap_istag_changes_total",
+			Help:        "number of times the ISTag of the service has changed",
+			ConstLabels: constLabels,
+		}),
+		promIcapOptionsPreview: prometheus.NewDesc(
+			"clamav_icap_options_preview_bytes",
+			"number of bytes the service wants to preview, NaN if it does not support previews",
+			[]string{},
+			constLabels),
+		promIcapOptionsMaxConns: prometheus.NewDesc(
+			"clamav_icap_options_max_connections",
+			"maximum number of concurrent connections the service accepts",
+			[]string{},
+			constLabels),
+		promIcapOptionsTTL: prometheus.NewDesc(
+			"clamav_icap_options_ttl_seconds",
+			"time for which the OPTIONS response is valid",
+			[]string{},
+			constLabels),
+		promIcapOptionsMethod: prometheus.NewDesc(
+			"clamav_icap_options_method_info",
+			"methods supported by the service",
+			[]string{"method"},
+			constLabels),
+		promIcapTLSHandshake: prometheus.NewDesc(
+			"clamav_icap_tls_handshake_seconds",
+			"duration of the TLS handshake of the connection which served the OPTIONS request",
+			[]string{},
+			constLabels),
+		promIcapTLSCertExpiry: prometheus.NewDesc(
+			"clamav_icap_tls_cert_expiry_timestamp_seconds",
+			"unix epoch timestamp at which the certificate of the service expires",
+			[]string{},
+			constLabels),
+		promIcapPath: prometheus.NewDesc(
+			"clamav_icap_path",
+			"how the service processed the scan request: full body, answered the preview or asked to continue after it",
+			[]string{"probe", "path"},
+			constLabels),
+		promIcapPhase: prometheus.NewDesc(
+			"clamav_icap_phase_seconds",
+			"duration of the phases of the scan request",
+			[]string{"probe", "phase"},
+			constLabels),
+		promIcapRequestTime: prometheus.NewDesc(
+			"clamav_icap_request_seconds",
+			"time from sending the request until the final response, without connecting",
+			[]string{"probe"},
+			constLabels),
+		promIcapConnReused: prometheus.NewDesc(
+			"clamav_icap_connection_reused",
+			"request has been answered over a persistent connection which already served another request",
+			[]string{"probe"},
+			constLabels),
+		promIcapConnsOpened: prometheus.NewDesc(
+			"clamav_icap_connections_opened",
+			"number of connections opened for the requests of the last probe",
+			[]string{},
+			constLabels),
+		promIcapConnReuseFailures: prometheus.NewDesc(
+			"clamav_icap_connection_reuse_failures",
+			"number of times the service closed the persistent connection instead of answering the next request",
+			[]string{},
+			constLabels),
+		promIcapTestPassed: prometheus.NewDesc(
+			"clamav_icap_test_passed",
+			"verdict of the service for the test file matches the expected one",
+			[]string{"test"},
+			constLabels),
+		promIcapTestDetected: prometheus.NewDesc(
+			"clamav_icap_test_detected",
+			"test file has been detected as a threat",
+			[]string{"test"},
+			constLabels),
+		promIcapTestIcapCode: prometheus.NewDesc(
+			"clamav_icap_test_icap_code",
+			"ICAP result code for the test file",
+			[]string{"test"},
+			constLabels),
+		promIcapTestThreat: prometheus.NewDesc(
+			"clamav_icap_test_threat_info",
+			"name of the threat found in the test file",
+			[]string{"test", "threat"},
+			constLabels),
+		promIcapProbeTimeout: prometheus.NewDesc(
+			"clamav_icap_probe_timeout",
+			"probe has been aborted because it exceeded its timeout",
+			[]string{"probe"},
+			constLabels),
+		promIcapProbeDuration: prometheus.NewDesc(
+			"clamav_icap_probe_duration_seconds",
+			"time it took to run the probe",
+			[]string{"probe"},
+			constLabels),
+		promIcapProbeLatency: newProbeLatency("icap", opts.LatencyBuckets, constLabels),
+		verdicts:             newVerdictTracker("icap", scanProbes, constLabels),
+		promIcapLastProbeTime: prometheus.NewDesc(
+			"clamav_icap_last_probe_timestamp_seconds",
+			"unix epoch timestamp of the last probe",
+			[]string{},
+			constLabels),
+		promIcapProbeAge: prometheus.NewDesc(
+			"clamav_icap_probe_age_seconds",
+			"age of the probe results served by this scrape",
+			[]string{},
+			constLabels),
 	}
 }
 
@@ -91,142 +324,686 @@ func (c *IcapChecker) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.promIcapEicarDetectionTime
 	ch <- c.promIcapHelloOK
 	ch <- c.promIcapHelloOKTime
+	ch <- c.promIcapOptionsStatusCode
+	ch <- c.promIcapISTag
+	c.promIcapISTagChanges.Describe(ch)
+	ch <- c.promIcapOptionsPreview
+	ch <- c.promIcapOptionsMaxConns
+	ch <- c.promIcapOptionsTTL
+	ch <- c.promIcapOptionsMethod
+	ch <- c.promIcapTLSHandshake
+	ch <- c.promIcapTLSCertExpiry
+	ch <- c.promIcapPath
+	ch <- c.promIcapPhase
+	ch <- c.promIcapRequestTime
+	ch <- c.promIcapConnReused
+	ch <- c.promIcapConnsOpened
+	ch <- c.promIcapConnReuseFailures
+	ch <- c.promIcapTestPassed
+	ch <- c.promIcapTestDetected
+	ch <- c.promIcapTestIcapCode
+	ch <- c.promIcapTestThreat
+	ch <- c.promIcapProbeTimeout
+	ch <- c.promIcapProbeDuration
+	c.promIcapProbeLatency.Describe(ch)
+	c.verdicts.Describe(ch)
+	ch <- c.promIcapLastProbeTime
+	ch <- c.promIcapProbeAge
 }
 
 func (c *IcapChecker) Collect(ch chan<- prometheus.Metric) {
+	c.CollectContext(context.Background(), ch)
+}
+
+func (c *IcapChecker) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	if c.opts.Background.enabled() {
+		c.mu.Lock()
+		last := c.last
+		c.mu.Unlock()
+		if last != nil {
+			c.collect(ch, *last)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeouts.Overall.Duration)
+	defer cancel()
+	c.collect(ch, c.probe(ctx))
+}
+
+// Run probes the icap service in the background until ctx is done, see BackgroundOptions.
+func (c *IcapChecker) Run(ctx context.Context) {
+	runBackground(ctx, c.opts.Background, func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, c.opts.Timeouts.Overall.Duration)
+		defer cancel()
+		res := c.probe(ctx)
+
+		c.mu.Lock()
+		c.last = &res
+		c.mu.Unlock()
+	})
+}
+
+// icapResult holds the outcome of all probes of a single scrape.
+type icapResult struct {
+	eicarErr          error
+	icapServerVersion string
+	eicarIcapCode     int
+	eicarDetected     int
+	eicarTrace        icapTrace
+	helloOK           int
+	helloTrace        icapTrace
+	options           icapOptionsResponse
+	optionsTrace      icapTrace
+	tls               *tlsState
+	connsOpened       int
+	reuseFailures     int
+	tests             []icapTestResult
+	probes            []probeStatus
+	time              time.Time
+}
+
+// icapTestResult is the verdict of the service for an IcapTestCase.
+type icapTestResult struct {
+	icapCode int
+	detected int
+	threat   string
+	passed   bool
+	trace    icapTrace
+}
+
+func (c *IcapChecker) probe(ctx context.Context) (res icapResult) {
+	res.time = time.Now()
+	s := c.newSession()
+	probes := []probe{
+		{"eicar", func(ctx context.Context) (err error) {
+			res.icapServerVersion, res.eicarIcapCode, res.eicarDetected, res.eicarTrace, err = c.collectEicar(ctx, s)
+			res.eicarErr = err
+			return
+		}},
+		{"hello", func(ctx context.Context) (err error) {
+			res.helloOK, res.helloTrace, err = c.collectHello(ctx, s)
+			return
+		}},
+		{"options", func(ctx context.Context) (err error) {
+			res.options, res.optionsTrace, err = c.collectOptions(ctx, s)
+			return
+		}},
+	}
+	res.tests = make([]icapTestResult, len(c.opts.Tests))
+	for i := range c.opts.Tests {
+		tc, tr := c.opts.Tests[i], &res.tests[i]
+		probes = append(probes, probe{tc.Name, func(ctx context.Context) (err error) {
+			*tr, err = c.collectTest(ctx, s, tc)
+			return
+		}})
+	}
+	res.probes = runProbes(ctx, c.opts.Parallelism, probes)
+	s.Close()
+	res.connsOpened, res.reuseFailures = s.stats()
+	res.tls = res.optionsTrace.tls
+	if probeErr(res.probes, "options") == nil {
+		c.mu.Lock()
+		if c.istag != "" && res.options.ISTag != c.istag {
+			c.promIcapISTagChanges.Inc()
+		}
+		c.istag = res.options.ISTag
+		c.preview, c.previewKnown = res.options.Preview, true
+		c.mu.Unlock()
+	}
+	logProbeErrors("icap", c.name, c.target(), res.probes)
+	observeProbes(c.promIcapProbeLatency, res.probes)
+	verdicts := []scanVerdict{
+		{"eicar", true, res.eicarDetected == 1, probeErr(res.probes, "eicar")},
+		{"hello", false, res.helloOK == 0, probeErr(res.probes, "hello")},
+	}
+	for i, tc := range c.opts.Tests {
+		verdicts = append(verdicts, scanVerdict{tc.Name, tc.Expect == "infected", res.tests[i].detected == 1, probeErr(res.probes, tc.Name)})
+	}
+	c.verdicts.observe(res.time, verdicts)
+	return
+}
+
+// target is the ICAP service which is probed, for logging.
+func (c *IcapChecker) target() string {
+	scheme := "icap://"
+	if c.opts.TLS != nil {
+		scheme = "icaps://"
+	}
+	return scheme + net.JoinHostPort(c.opts.Host, c.opts.Port) + "/" + c.opts.Service
+}
+
+func (c *IcapChecker) collect(ch chan<- prometheus.Metric, res icapResult) {
 	up := 1.0
-	icapServerVersion, eicarIcapCode, eicarDetected, eicarTime, err := c.collectEicar()
-	if err != nil {
+	if res.eicarErr != nil {
 		up = 0
 	}
 	ch <- prometheus.MustNewConstMetric(
 		c.promIcapUp,
 		prometheus.GaugeValue,
 		up,
-		icapServerVersion,
+		res.icapServerVersion,
 	)
 	ch <- prometheus.MustNewConstMetric(
 		c.promIcapEicarIcapCode,
 		prometheus.GaugeValue,
-		float64(eicarIcapCode),
+		float64(res.eicarIcapCode),
 	)
 	ch <- prometheus.MustNewConstMetric(
 		c.promIcapEicarDetected,
 		prometheus.GaugeValue,
-		float64(eicarDetected),
+		float64(res.eicarDetected),
 	)
 	ch <- prometheus.MustNewConstMetric(
 		c.promIcapEicarDetectionTime,
 		prometheus.GaugeValue,
-		eicarTime,
+		res.eicarTrace.elapsed,
 	)
 
-	helloOK, helloTime := c.collectHello()
-
 	ch <- prometheus.MustNewConstMetric(
 		c.promIcapHelloOK,
 		prometheus.GaugeValue,
-		float64(helloOK),
+		float64(res.helloOK),
 	)
 	ch <- prometheus.MustNewConstMetric(
 		c.promIcapHelloOKTime,
 		prometheus.GaugeValue,
-		helloTime,
+		res.helloTrace.elapsed,
+	)
+
+	c.collectOptionsMetrics(ch, res)
+	collectTLS(ch, c.promIcapTLSHandshake, c.promIcapTLSCertExpiry, res.tls)
+	c.collectTestMetrics(ch, res)
+	c.collectTrace(ch, "eicar", res.eicarTrace)
+	c.collectTrace(ch, "hello", res.helloTrace)
+	c.collectTrace(ch, "options", res.optionsTrace)
+	for i, tc := range c.opts.Tests {
+		c.collectTrace(ch, tc.Name, res.tests[i].trace)
+	}
+	if c.opts.KeepAlive {
+		ch <- prometheus.MustNewConstMetric(
+			c.promIcapConnsOpened,
+			prometheus.GaugeValue,
+			float64(res.connsOpened),
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.promIcapConnReuseFailures,
+			prometheus.GaugeValue,
+			float64(res.reuseFailures),
+		)
+	}
+
+	for _, p := range res.probes {
+		ch <- prometheus.MustNewConstMetric(
+			c.promIcapProbeTimeout,
+			prometheus.GaugeValue,
+			boolToFloat(isTimeout(p.err)),
+			p.name,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.promIcapProbeDuration,
+			prometheus.GaugeValue,
+			p.duration.Seconds(),
+			p.name,
+		)
+	}
+	c.promIcapProbeLatency.Collect(ch)
+	c.verdicts.Collect(ch)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.promIcapLastProbeTime,
+		prometheus.GaugeValue,
+		float64(res.time.UnixNano())/1e9,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		c.promIcapProbeAge,
+		prometheus.GaugeValue,
+		time.Since(res.time).Seconds(),
 	)
 }
 
-func (c *IcapChecker) collectEicar() (icapServerVersion string, icapCode, threatDetected int, threatElapsed float64, err error) {
-	return c.testIcap(clamd.EICAR)
+func (c *IcapChecker) collectEicar(ctx context.Context, s *icapSession) (icapServerVersion string, icapCode, threatDetected int, trace icapTrace, err error) {
+	var res *icapResponse
+	res, trace, err = c.testIcap(ctx, s, eicar)
+	if err != nil {
+		return
+	}
+	icapServerVersion, icapCode = res.ServerVersion(), res.Code
+	if res.Detected(c.opts.Method) {
+		threatDetected = 1
+	}
+	return
 }
 
-func (c *IcapChecker) collectHello() (helloOK int, helloElapsed float64) {
-	var err error
-	var helloIsThreat int
-	_, _, helloIsThreat, helloElapsed, err = c.testIcap([]byte("I am a totally legit non-threatening Hello message from The Beyond!"))
+func (c *IcapChecker) collectHello(ctx context.Context, s *icapSession) (helloOK int, trace icapTrace, err error) {
+	var res *icapResponse
+	res, trace, err = c.testIcap(ctx, s, []byte("I am a totally legit non-threatening Hello message from The Beyond!"))
 	if err != nil {
 		return
 	}
-	if helloIsThreat == 0 {
+	if !res.Detected(c.opts.Method) {
 		helloOK = 1
 	}
 	return
 }
 
-func (c *IcapChecker) testIcap(data []byte) (icapServerVersion string, icapCode, detected int, elapsed float64, err error) {
-	elapsed = math.NaN()
-
-	hostPort := net.JoinHostPort(c.opts.Host, c.opts.Port)
-	var addr *net.TCPAddr
-	if addr, err = net.ResolveTCPAddr("tcp", hostPort); err != nil {
+// collectTest scans the file of a test case, which is read on every probe so
+// that it can be replaced without a restart.
+func (c *IcapChecker) collectTest(ctx context.Context, s *icapSession, tc IcapTestCase) (tr icapTestResult, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(tc.File); err != nil {
 		return
 	}
-
-	start := time.Now()
-	defer func() {
-		elapsed = time.Since(start).Seconds()
-	}()
-
-	var conn *net.TCPConn
-	if conn, err = net.DialTCP("tcp", nil, addr); err != nil {
+	var res *icapResponse
+	if res, tr.trace, err = c.testIcap(ctx, s, data); err != nil {
 		return
 	}
-	defer conn.Close()
+	tr.icapCode = res.Code
+	_, tr.threat = res.Threat()
+	detected := res.Detected(c.opts.Method)
+	if detected {
+		tr.detected = 1
+	}
+	switch tc.Expect {
+	case "clean":
+		tr.passed = !detected
+	case "infected":
+		tr.passed = detected && (tc.Signature == "" || tc.Signature == tr.threat)
+	}
+	return
+}
+
+func (c *IcapChecker) collectTestMetrics(ch chan<- prometheus.Metric, res icapResult) {
+	for i, tc := range c.opts.Tests {
+		tr := res.tests[i]
+		ch <- prometheus.MustNewConstMetric(
+			c.promIcapTestPassed,
+			prometheus.GaugeValue,
+			boolToFloat(tr.passed),
+			tc.Name,
+		)
+		if probeErr(res.probes, tc.Name) != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			c.promIcapTestDetected,
+			prometheus.GaugeValue,
+			float64(tr.detected),
+			tc.Name,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.promIcapTestIcapCode,
+			prometheus.GaugeValue,
+			float64(tr.icapCode),
+			tc.Name,
+		)
+		if tr.threat != "" {
+			ch <- prometheus.MustNewConstMetric(
+				c.promIcapTestThreat,
+				prometheus.GaugeValue,
+				1,
+				tc.Name,
+				tr.threat,
+			)
+		}
+	}
+}
+
+// icapOptionsResponse is the response of the service to an OPTIONS request,
+// see https://tools.ietf.org/html/rfc3507#section-4.10. Missing numeric
+// headers are NaN.
+type icapOptionsResponse struct {
+	Code           int
+	ISTag          string
+	Methods        []string
+	Preview        float64
+	MaxConnections float64
+	OptionsTTL     float64
+}
+
+func (c *IcapChecker) collectOptions(ctx context.Context, s *icapSession) (opts icapOptionsResponse, trace icapTrace, err error) {
+	hostPort := net.JoinHostPort(c.opts.Host, c.opts.Port)
 
-	req := bytes.NewBuffer(nil) // TODO pre-alloc correct size
-	req.WriteString(fmt.Sprintf("RESPMOD icap://%s/%s ICAP/1.0\r\n", hostPort, c.opts.Service))
+	var req bytes.Buffer
+	req.WriteString(fmt.Sprintf("OPTIONS icap://%s/%s ICAP/1.0\r\n", hostPort, c.opts.Service))
 	req.WriteString(fmt.Sprintf("Host: %s\r\n", hostPort))
 	req.WriteString("User-Agent: clamav-exporter\r\n")
-	// see Allow: 204 in https://tools.ietf.org/html/rfc3507#section-4.6
-	req.WriteString("Allow: 204\r\n")
-	httpHeader := fmt.Sprintf("Content-Length: %d\r\n\r\n", len(clamd.EICAR))
-	req.WriteString(fmt.Sprintf("Encapsulated: res-hdr=0, res-body=%d\r\n", len(httpHeader)))
-	req.WriteString("\r\n")
-	req.WriteString(httpHeader)
-
-	req.WriteString(fmt.Sprintf("%x\r\n", len(data)))
-	req.Write(data)
+	req.WriteString("Encapsulated: null-body=0\r\n")
 	req.WriteString("\r\n")
-	req.WriteString("0; ieof\r\n\r\n")
 
-	reqLen := req.Len()
-	var n int64
-	n, err = io.Copy(conn, req)
+	var res *icapResponse
+	res, err = s.roundTrip(ctx, &trace, func(conn net.Conn, r *bufio.Reader) (*icapResponse, error) {
+		if _, err := conn.Write(req.Bytes()); err != nil {
+			return nil, err
+		}
+		res, err := readIcapResponse(r)
+		trace.phase("response")
+		return res, err
+	})
 	if err != nil {
+		opts.Preview, opts.MaxConnections, opts.OptionsTTL = math.NaN(), math.NaN(), math.NaN()
 		return
 	}
-	if n != int64(reqLen) {
-		err = errors.New("partial write of eicar request")
+	opts, err = parseIcapOptions(res)
+	return
+}
+
+func parseIcapOptions(res *icapResponse) (opts icapOptionsResponse, err error) {
+	opts.Preview, opts.MaxConnections, opts.OptionsTTL = math.NaN(), math.NaN(), math.NaN()
+	opts.Code = res.Code
+	if opts.Code != 200 {
+		err = fmt.Errorf("ICAP OPTIONS failed: %d %s", res.Code, res.Status)
 		return
 	}
+	hdr := res.Header
 
-	err = conn.CloseWrite()
-	if err != nil {
-		return
+	opts.ISTag = strings.Trim(hdr.Get("ISTag"), `"`)
+	seen := make(map[string]bool)
+	for _, m := range strings.Split(hdr.Get("Methods"), ",") {
+		if m = strings.TrimSpace(m); m != "" && !seen[m] {
+			seen[m] = true
+			opts.Methods = append(opts.Methods, m)
+		}
 	}
+	for _, h := range []struct {
+		name  string
+		value *float64
+	}{
+		{"Preview", &opts.Preview},
+		{"Max-Connections", &opts.MaxConnections},
+		{"Options-TTL", &opts.OptionsTTL},
+	} {
+		v := hdr.Get(h.name)
+		if v == "" {
+			continue
+		}
+		if *h.value, err = strconv.ParseFloat(v, 64); err != nil {
+			err = fmt.Errorf("invalid ICAP %s header %q", h.name, v)
+			return
+		}
+	}
+	return
+}
 
-	var res []byte
-	if res, err = ioutil.ReadAll(conn); err != nil {
+func (c *IcapChecker) collectOptionsMetrics(ch chan<- prometheus.Metric, res icapResult) {
+	code := math.NaN()
+	if res.options.Code != 0 {
+		code = float64(res.options.Code)
+	}
+	ch <- prometheus.MustNewConstMetric(
+		c.promIcapOptionsStatusCode,
+		prometheus.GaugeValue,
+		code,
+	)
+	c.promIcapISTagChanges.Collect(ch)
+	if probeErr(res.probes, "options") != nil {
 		return
 	}
 
-	icapServerVersion, icapCode, detected = parseIcapResult(res)
+	if res.options.ISTag != "" {
+		ch <- prometheus.MustNewConstMetric(
+			c.promIcapISTag,
+			prometheus.GaugeValue,
+			1,
+			res.options.ISTag,
+		)
+	}
+	ch <- prometheus.MustNewConstMetric(
+		c.promIcapOptionsPreview,
+		prometheus.GaugeValue,
+		res.options.Preview,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		c.promIcapOptionsMaxConns,
+		prometheus.GaugeValue,
+		res.options.MaxConnections,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		c.promIcapOptionsTTL,
+		prometheus.GaugeValue,
+		res.options.OptionsTTL,
+	)
+	for _, m := range res.options.Methods {
+		ch <- prometheus.MustNewConstMetric(
+			c.promIcapOptionsMethod,
+			prometheus.GaugeValue,
+			1,
+			m,
+		)
+	}
+}
+
+// icapTrace records how the service processed a scan request.
+type icapTrace struct {
+	// path is "full" if the whole body has been sent at once, "preview" if
+	// the service answered the preview and "continue" if it asked for the
+	// rest of the body with 100 Continue
+	path    string
+	phases  []icapPhase
+	elapsed float64
+	// request is the time from sending the request until the final response
+	// and answered is set once it has arrived
+	request  time.Duration
+	answered bool
+	// reused is set if the request has been sent over a persistent
+	// connection which already served another request
+	reused bool
+	// tls is the state of the connection the request has been sent over,
+	// nil for plain connections
+	tls *tlsState
+
+	phaseStart time.Time
+}
+
+// start begins the next phase.
+func (t *icapTrace) start() {
+	t.phaseStart = time.Now()
+}
+
+// phase ends the current phase and begins the next one.
+func (t *icapTrace) phase(name string) {
+	now := time.Now()
+	t.phases = append(t.phases, icapPhase{name, now.Sub(t.phaseStart)})
+	t.phaseStart = now
+}
+
+// icapPhase is the duration of a step of a scan request: "connect",
+// "preview" until the response to the preview and "response" until the
+// final response after sending the (remaining) body.
+type icapPhase struct {
+	name     string
+	duration time.Duration
+}
+
+var icapPaths = []string{"full", "preview", "continue"}
+
+// testIcap scans data with the configured method and returns the response of
+// the service.
+func (c *IcapChecker) testIcap(ctx context.Context, s *icapSession, data []byte) (res *icapResponse, trace icapTrace, err error) {
+	trace.elapsed = math.NaN()
+
+	hostPort := net.JoinHostPort(c.opts.Host, c.opts.Port)
+
+	preview := -1
+	if c.opts.Preview {
+		var size float64
+		if size, err = c.previewSize(ctx, s); err != nil {
+			return
+		}
+		if !math.IsNaN(size) {
+			preview = int(size)
+		}
+	}
+
+	res, err = s.roundTrip(ctx, &trace, func(conn net.Conn, r *bufio.Reader) (*icapResponse, error) {
+		if preview < 0 {
+			trace.path = "full"
+			req := bytes.NewBuffer(icapScanRequest(c.opts.Method, hostPort, c.opts.Service, c.opts.ContentType, data, -1))
+			reqLen := req.Len()
+			n, err := io.Copy(conn, req)
+			if err != nil {
+				return nil, err
+			}
+			if n != int64(reqLen) {
+				return nil, errors.New("partial write of scan request")
+			}
+			if !c.opts.KeepAlive {
+				if err := conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+					return nil, err
+				}
+			}
+			res, err := readIcapResponse(r)
+			trace.phase("response")
+			return res, err
+		}
+
+		if _, err := conn.Write(icapScanRequest(c.opts.Method, hostPort, c.opts.Service, c.opts.ContentType, data, preview)); err != nil {
+			return nil, err
+		}
+		res, err := readIcapResponse(r)
+		if err != nil {
+			return nil, err
+		}
+		trace.phase("preview")
+		if res.Code != 100 {
+			// e.g. 204 if the service does not need to see the rest
+			trace.path = "preview"
+			return res, nil
+		}
+		if preview >= len(data) {
+			return nil, errors.New("ICAP service asked to continue after the complete body")
+		}
+		trace.path = "continue"
+		if _, err := conn.Write(icapChunks(data[preview:], false)); err != nil {
+			return nil, err
+		}
+		res, err = readIcapResponse(r)
+		trace.phase("response")
+		return res, err
+	})
 	return
 }
 
-func parseIcapResult(icapRes []byte) (serverVersion string, code, found int) {
-	code = -1
+// previewSize returns the Preview size of the service, which is read from an
+// OPTIONS response if the options probe has not done so yet.
+func (c *IcapChecker) previewSize(ctx context.Context, s *icapSession) (float64, error) {
+	c.mu.Lock()
+	preview, known := c.preview, c.previewKnown
+	c.mu.Unlock()
+	if known {
+		return preview, nil
+	}
+	opts, _, err := c.collectOptions(ctx, s)
+	if err != nil {
+		return 0, err
+	}
+	c.setPreviewSize(opts.Preview)
+	return opts.Preview, nil
+}
+
+func (c *IcapChecker) setPreviewSize(preview float64) {
+	c.mu.Lock()
+	c.preview, c.previewKnown = preview, true
+	c.mu.Unlock()
+}
 
-	v := icapServerVersionRegexp.FindSubmatch(icapRes)
-	if len(v) == 2 {
-		serverVersion = string(v[1])
+func (c *IcapChecker) collectTrace(ch chan<- prometheus.Metric, probe string, trace icapTrace) {
+	if trace.path != "" {
+		for _, path := range icapPaths {
+			ch <- prometheus.MustNewConstMetric(
+				c.promIcapPath,
+				prometheus.GaugeValue,
+				boolToFloat(path == trace.path),
+				probe,
+				path,
+			)
+		}
 	}
-	c := icapRespCodeRegexp.FindSubmatch(icapRes)
-	if len(c) == 2 {
-		code, _ = strconv.Atoi(string(c[1]))
+	for _, p := range trace.phases {
+		ch <- prometheus.MustNewConstMetric(
+			c.promIcapPhase,
+			prometheus.GaugeValue,
+			p.duration.Seconds(),
+			probe,
+			p.name,
+		)
 	}
-	t := icapRespThreatFoundRegexp.FindSubmatch(icapRes)
-	if len(t) == 2 {
-		found = 1
+	if !trace.answered {
+		return
 	}
-	return
+	ch <- prometheus.MustNewConstMetric(
+		c.promIcapRequestTime,
+		prometheus.GaugeValue,
+		trace.request.Seconds(),
+		probe,
+	)
+	if c.opts.KeepAlive {
+		ch <- prometheus.MustNewConstMetric(
+			c.promIcapConnReused,
+			prometheus.GaugeValue,
+			boolToFloat(trace.reused),
+			probe,
+		)
+	}
+}
+
+// icapScanRequest builds a RESPMOD or REQMOD request which encapsulates data
+// as body of an HTTP response or of an HTTP POST request. Unless preview is
+// negative, only the first preview bytes of the body are included.
+func icapScanRequest(method, hostPort, service, contentType string, data []byte, preview int) []byte {
+	var httpHeader, encapsulated string
+	if method == "REQMOD" {
+		httpHeader = "POST /upload HTTP/1.1\r\n" +
+			"Host: clamav-exporter.invalid\r\n" +
+			fmt.Sprintf("Content-Type: %s\r\n", contentType) +
+			fmt.Sprintf("Content-Length: %d\r\n\r\n", len(data))
+		encapsulated = fmt.Sprintf("req-hdr=0, req-body=%d", len(httpHeader))
+	} else {
+		httpHeader = "HTTP/1.1 200 OK\r\n" +
+			fmt.Sprintf("Content-Type: %s\r\n", contentType) +
+			fmt.Sprintf("Content-Length: %d\r\n\r\n", len(data))
+		encapsulated = fmt.Sprintf("res-hdr=0, res-body=%d", len(httpHeader))
+	}
+
+	var req bytes.Buffer
+	req.WriteString(fmt.Sprintf("%s icap://%s/%s ICAP/1.0\r\n", method, hostPort, service))
+	req.WriteString(fmt.Sprintf("Host: %s\r\n", hostPort))
+	req.WriteString("User-Agent: clamav-exporter\r\n")
+	// see Allow: 204 in https://tools.ietf.org/html/rfc3507#section-4.6
+	req.WriteString("Allow: 204\r\n")
+	if preview >= 0 {
+		req.WriteString(fmt.Sprintf("Preview: %d\r\n", preview))
+	}
+	req.WriteString(fmt.Sprintf("Encapsulated: %s\r\n", encapsulated))
+	req.WriteString("\r\n")
+	req.WriteString(httpHeader)
+
+	switch {
+	case preview < 0:
+		req.Write(icapChunks(data, false))
+	case preview >= len(data):
+		// the ieof extension tells that the preview holds the complete body
+		req.Write(icapChunks(data, true))
+	default:
+		req.Write(icapChunks(data[:preview], false))
+	}
+	return req.Bytes()
+}
+
+// icapChunks encodes data as a single chunk followed by the last chunk. Only
+// a preview which holds the complete body may set ieof, see
+// https://tools.ietf.org/html/rfc3507#section-4.5
+func icapChunks(data []byte, ieof bool) []byte {
+	var b bytes.Buffer
+	if len(data) > 0 {
+		b.WriteString(fmt.Sprintf("%x\r\n", len(data)))
+		b.Write(data)
+		b.WriteString("\r\n")
+	}
+	if ieof {
+		b.WriteString("0; ieof\r\n\r\n")
+	} else {
+		b.WriteString("0\r\n\r\n")
+	}
+	return b.Bytes()
 }
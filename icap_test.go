@@ -0,0 +1,544 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeIcap implements the parts of a c-icap server with squidclamav which
+// are used by the exporter.
+type fakeIcap struct {
+	l net.Listener
+
+	mu           sync.Mutex
+	istag        string
+	contentTypes []string
+	// preview is the Preview size of the OPTIONS response, none if empty
+	preview string
+	// answerPreview makes the service answer every preview with 204
+	// instead of asking for the rest of the body
+	answerPreview bool
+	// maxRequests closes connections after as many requests, if set
+	maxRequests int
+	connections int
+}
+
+func newFakeIcap(t *testing.T) *fakeIcap {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return serveFakeIcap(l)
+}
+
+// serveFakeIcap accepts connections on l, e.g. a TLS listener.
+func serveFakeIcap(l net.Listener) *fakeIcap {
+	f := &fakeIcap{l: l, istag: "CI0001-XXXXXXXXX", preview: "1024"}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.connections++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeIcap) Close() error {
+	return f.l.Close()
+}
+
+// options returns the IcapOptions of a checker for the fake server.
+func (f *fakeIcap) options() IcapOptions {
+	host, port, _ := net.SplitHostPort(f.l.Addr().String())
+	return IcapOptions{Host: host, Port: port, Service: "squidclamav"}
+}
+
+func (f *fakeIcap) setISTag(istag string) {
+	f.mu.Lock()
+	f.istag = istag
+	f.mu.Unlock()
+}
+
+func (f *fakeIcap) setPreview(preview string, answer bool) {
+	f.mu.Lock()
+	f.preview, f.answerPreview = preview, answer
+	f.mu.Unlock()
+}
+
+// contentType returns the Content-Type of the last scanned message.
+func (f *fakeIcap) contentType() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.contentTypes) == 0 {
+		return ""
+	}
+	return f.contentTypes[len(f.contentTypes)-1]
+}
+
+func (f *fakeIcap) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for n := 1; f.serveRequest(conn, r); n++ {
+		f.mu.Lock()
+		maxRequests := f.maxRequests
+		f.mu.Unlock()
+		if maxRequests > 0 && n >= maxRequests {
+			// close the idle connection without telling the client
+			return
+		}
+	}
+}
+
+// serveRequest answers a single request and reports whether the connection
+// can be used for another one.
+func (f *fakeIcap) serveRequest(conn net.Conn, r *bufio.Reader) bool {
+	tp := textproto.NewReader(r)
+
+	line, err := tp.ReadLine()
+	if err != nil {
+		return false
+	}
+	hdr, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return false
+	}
+	f.mu.Lock()
+	istag, preview, answerPreview := f.istag, f.preview, f.answerPreview
+	f.mu.Unlock()
+
+	method := strings.Fields(line)[0]
+	var body []byte
+	if method == "REQMOD" || method == "RESPMOD" {
+		var httpHdr textproto.MIMEHeader
+		var ieof bool
+		if body, httpHdr, ieof, err = readFakeIcapMessage(r, hdr.Get("Encapsulated")); err != nil {
+			fmt.Fprintf(conn, "ICAP/1.0 400 Bad Request\r\n\r\n")
+			return false
+		}
+		if hdr.Get("Preview") != "" && !ieof {
+			if answerPreview {
+				fmt.Fprintf(conn, "ICAP/1.0 204 Unmodified\r\n"+
+					"ISTag: \"%s\"\r\n"+
+					"Encapsulated: null-body=0\r\n\r\n", istag)
+				return false
+			}
+			fmt.Fprintf(conn, "ICAP/1.0 100 Continue\r\n\r\n")
+			rest, _, err := readFakeIcapChunks(r)
+			if err != nil {
+				return false
+			}
+			body = append(body, rest...)
+		}
+		if cl := httpHdr.Get("Content-Length"); cl != strconv.Itoa(len(body)) {
+			fmt.Fprintf(conn, "ICAP/1.0 400 Bad Request\r\n\r\n")
+			return false
+		}
+		f.mu.Lock()
+		f.contentTypes = append(f.contentTypes, httpHdr.Get("Content-Type"))
+		f.mu.Unlock()
+	}
+
+	switch method {
+	case "OPTIONS":
+		if preview != "" {
+			preview = "Preview: " + preview + "\r\n"
+		}
+		fmt.Fprintf(conn, "ICAP/1.0 200 OK\r\n"+
+			"Methods: RESPMOD, REQMOD\r\n"+
+			"Service: C-ICAP/0.5.6 server - SquidClamav/Antivirus service\r\n"+
+			"ISTag: \"%s\"\r\n"+
+			"Transfer-Preview: *\r\n"+
+			"Options-TTL: 3600\r\n"+
+			"Max-Connections: 600\r\n"+
+			"%s"+
+			"Allow: 204\r\n"+
+			"Encapsulated: null-body=0\r\n\r\n", istag, preview)
+	case "REQMOD":
+		if bytes.Contains(body, eicar) {
+			// the request is blocked by a response, like squidclamav does
+			// without X-Infection-Found
+			fmt.Fprintf(conn, "ICAP/1.0 200 OK\r\n"+
+				"Server: C-ICAP/0.5.6\r\n"+
+				"ISTag: \"%s\"\r\n"+
+				"Encapsulated: res-hdr=0, null-body=26\r\n\r\n"+
+				"HTTP/1.1 403 Forbidden\r\n\r\n", istag)
+		} else {
+			fmt.Fprintf(conn, "ICAP/1.0 204 Unmodified\r\n"+
+				"Server: C-ICAP/0.5.6\r\n"+
+				"ISTag: \"%s\"\r\n"+
+				"Encapsulated: null-body=0\r\n\r\n", istag)
+		}
+	case "RESPMOD":
+		if bytes.Contains(body, eicar) {
+			fmt.Fprintf(conn, "ICAP/1.0 200 OK\r\n"+
+				"Server: C-ICAP/0.5.6\r\n"+
+				"ISTag: \"%s\"\r\n"+
+				"X-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Test-Signature;\r\n"+
+				"Encapsulated: res-hdr=0, null-body=26\r\n\r\n"+
+				"HTTP/1.1 403 Forbidden\r\n\r\n", istag)
+		} else {
+			fmt.Fprintf(conn, "ICAP/1.0 204 Unmodified\r\n"+
+				"Server: C-ICAP/0.5.6\r\n"+
+				"ISTag: \"%s\"\r\n"+
+				"Encapsulated: null-body=0\r\n\r\n", istag)
+		}
+	default:
+		fmt.Fprintf(conn, "ICAP/1.0 405 Method Not Allowed\r\n\r\n")
+	}
+	return true
+}
+
+// readFakeIcapMessage reads the encapsulated HTTP header and the chunked body
+// up to the last chunk, which ends the preview if the request has one.
+func readFakeIcapMessage(r *bufio.Reader, encapsulated string) (body []byte, hdr textproto.MIMEHeader, ieof bool, err error) {
+	tp := textproto.NewReader(r)
+	if !strings.HasPrefix(encapsulated, "req-hdr=0,") && !strings.HasPrefix(encapsulated, "res-hdr=0,") {
+		err = fmt.Errorf("unexpected Encapsulated header %q", encapsulated)
+		return
+	}
+	if _, err = tp.ReadLine(); err != nil {
+		return
+	}
+	if hdr, err = tp.ReadMIMEHeader(); err != nil {
+		return
+	}
+	body, ieof, err = readFakeIcapChunks(r)
+	return
+}
+
+func readFakeIcapChunks(r *bufio.Reader) (body []byte, ieof bool, err error) {
+	for {
+		var line string
+		if line, err = r.ReadString('\n'); err != nil {
+			return
+		}
+		f := strings.SplitN(strings.TrimSpace(line), ";", 2)
+		var size int64
+		if size, err = strconv.ParseInt(strings.TrimSpace(f[0]), 16, 64); err != nil {
+			return
+		}
+		if size == 0 {
+			ieof = len(f) == 2 && strings.TrimSpace(f[1]) == "ieof"
+			_, err = r.ReadString('\n')
+			return
+		}
+		chunk := make([]byte, size+2)
+		if _, err = io.ReadFull(r, chunk); err != nil {
+			return
+		}
+		body = append(body, chunk[:size]...)
+	}
+}
+
+func TestParseIcapOptions(t *testing.T) {
+	r := require.New(t)
+
+	parse := func(raw string) (icapOptionsResponse, error) {
+		res, err := readIcapResponse(bufio.NewReader(strings.NewReader(raw)))
+		if err != nil {
+			return icapOptionsResponse{}, err
+		}
+		return parseIcapOptions(res)
+	}
+
+	opts, err := parse("ICAP/1.0 200 OK\r\n" +
+		"Methods: RESPMOD, REQMOD\r\n" +
+		"ISTag: \"CI0001-2-squidclamav-10\"\r\n" +
+		"Max-Connections: 600\r\n" +
+		"Options-TTL: 3600\r\n" +
+		"Encapsulated: null-body=0\r\n\r\n")
+	r.NoError(err)
+	r.Equal(200, opts.Code)
+	r.Equal("CI0001-2-squidclamav-10", opts.ISTag)
+	r.Equal([]string{"RESPMOD", "REQMOD"}, opts.Methods)
+	r.True(math.IsNaN(opts.Preview))
+	r.Equal(600.0, opts.MaxConnections)
+	r.Equal(3600.0, opts.OptionsTTL)
+
+	opts, err = parse("ICAP/1.0 404 ICAP Service not found\r\n\r\n")
+	r.Error(err)
+	r.Equal(404, opts.Code)
+
+	_, err = parse("HTTP/1.1 200 OK\r\n\r\n")
+	r.Error(err)
+
+	_, err = parse("ICAP/1.0 200 OK\r\nPreview: lots\r\n\r\n")
+	r.Error(err)
+}
+
+func TestIcapCheckerOptions(t *testing.T) {
+	r := require.New(t)
+	f := newFakeIcap(t)
+	defer f.Close()
+
+	c := NewIcapChecker("proxy", f.options())
+	gather := func() map[string]float64 {
+		return gatherMetrics(t, c, "istag", "method")
+	}
+
+	values := gather()
+	r.Equal(1.0, values["clamav_icap_up"])
+	r.Equal(1.0, values["clamav_icap_eicar_detected"])
+	r.Equal(1.0, values["clamav_icap_hello_ok"])
+	r.Equal(200.0, values["clamav_icap_options_status_code"])
+	r.Equal(1.0, values["clamav_icap_istag_info/CI0001-XXXXXXXXX"])
+	r.Equal(1024.0, values["clamav_icap_options_preview_bytes"])
+	r.Equal(600.0, values["clamav_icap_options_max_connections"])
+	r.Equal(3600.0, values["clamav_icap_options_ttl_seconds"])
+	r.Equal(1.0, values["clamav_icap_options_method_info/RESPMOD"])
+	r.Equal(1.0, values["clamav_icap_options_method_info/REQMOD"])
+	r.Equal(0.0, values["clamav_icap_istag_changes_total"])
+
+	// the signatures have been reloaded
+	f.setISTag("CI0001-YYYYYYYYY")
+	values = gather()
+	r.Equal(1.0, values["clamav_icap_istag_info/CI0001-YYYYYYYYY"])
+	r.NotContains(values, "clamav_icap_istag_info/CI0001-XXXXXXXXX")
+	r.Equal(1.0, values["clamav_icap_istag_changes_total"])
+
+	values = gather()
+	r.Equal(1.0, values["clamav_icap_istag_changes_total"])
+}
+
+func TestIcapCheckerReqmod(t *testing.T) {
+	r := require.New(t)
+	f := newFakeIcap(t)
+	defer f.Close()
+
+	opts := f.options()
+	opts.Method = "reqmod"
+	r.NoError(opts.validate())
+	c := NewIcapChecker("", opts)
+	res := c.probe(context.Background())
+	r.NoError(probeErr(res.probes, "eicar"))
+	r.Equal(200, res.eicarIcapCode)
+	r.Equal(1, res.eicarDetected)
+	r.Equal(1, res.helloOK)
+
+	opts.Method = "OPTIONS"
+	r.Error(opts.validate())
+}
+
+func TestIcapScanRequest(t *testing.T) {
+	r := require.New(t)
+	data := []byte("hello")
+	for _, tc := range []struct {
+		method  string
+		preview int
+		body    string
+		ieof    bool
+		end     string
+	}{
+		{"RESPMOD", -1, "hello", false, "hello\r\n0\r\n\r\n"},
+		{"REQMOD", -1, "hello", false, "hello\r\n0\r\n\r\n"},
+		{"RESPMOD", 2, "he", false, "\r\nhe\r\n0\r\n\r\n"},
+		{"RESPMOD", 5, "hello", true, "hello\r\n0; ieof\r\n\r\n"},
+		{"RESPMOD", 8, "hello", true, "hello\r\n0; ieof\r\n\r\n"},
+		{"REQMOD", 0, "", false, "\r\n\r\n0\r\n\r\n"},
+	} {
+		req := icapScanRequest(tc.method, "127.0.0.1:1344", "avscan", "text/plain", data, tc.preview)
+		r.True(bytes.HasSuffix(req, []byte(tc.end)), "%+v: %q", tc, req)
+		br := bufio.NewReader(bytes.NewReader(req))
+		tp := textproto.NewReader(br)
+		line, err := tp.ReadLine()
+		r.NoError(err)
+		r.Equal(tc.method+" icap://127.0.0.1:1344/avscan ICAP/1.0", line)
+		hdr, err := tp.ReadMIMEHeader()
+		r.NoError(err)
+		if tc.preview >= 0 {
+			r.Equal(strconv.Itoa(tc.preview), hdr.Get("Preview"))
+		} else {
+			r.Empty(hdr.Get("Preview"))
+		}
+		body, httpHdr, ieof, err := readFakeIcapMessage(br, hdr.Get("Encapsulated"))
+		r.NoError(err)
+		r.Equal(tc.body, string(body), "%+v", tc)
+		r.Equal(tc.ieof, ieof, "%+v", tc)
+		r.Equal("5", httpHdr.Get("Content-Length"))
+		r.Equal("text/plain", httpHdr.Get("Content-Type"))
+		r.Equal(0, br.Buffered())
+	}
+}
+
+func TestIcapCheckerTests(t *testing.T) {
+	r := require.New(t)
+	f := newFakeIcap(t)
+	defer f.Close()
+
+	dir, err := ioutil.TempDir("", "clamav-exporter-test")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	clean := filepath.Join(dir, "clean.txt")
+	r.NoError(ioutil.WriteFile(clean, []byte("hello"), 0644))
+	infected := filepath.Join(dir, "eicar.com")
+	r.NoError(ioutil.WriteFile(infected, eicar, 0644))
+
+	opts := f.options()
+	opts.ContentType = "text/plain"
+	opts.Tests = []IcapTestCase{
+		{Name: "clean", File: clean, Expect: "clean"},
+		{Name: "eicar-file", File: infected, Expect: "infected", Signature: "Eicar-Test-Signature"},
+		{Name: "wrong-signature", File: infected, Expect: "infected", Signature: "Win.Test.EICAR_HDB-1"},
+		{Name: "missed", File: clean, Expect: "infected"},
+		{Name: "missing", File: filepath.Join(dir, "missing"), Expect: "clean"},
+	}
+	r.NoError(opts.validate())
+
+	values := gatherMetrics(t, NewIcapChecker("", opts), "test", "threat")
+
+	r.Equal(1.0, values["clamav_icap_hello_ok"])
+	r.Equal(1.0, values["clamav_icap_test_passed/clean"])
+	r.Equal(0.0, values["clamav_icap_test_detected/clean"])
+	r.Equal(204.0, values["clamav_icap_test_icap_code/clean"])
+	r.Equal(1.0, values["clamav_icap_test_passed/eicar-file"])
+	r.Equal(1.0, values["clamav_icap_test_detected/eicar-file"])
+	r.Equal(1.0, values["clamav_icap_test_threat_info/eicar-file/Eicar-Test-Signature"])
+	r.Equal(0.0, values["clamav_icap_test_passed/wrong-signature"])
+	r.Equal(1.0, values["clamav_icap_test_detected/wrong-signature"])
+	r.Equal(0.0, values["clamav_icap_test_passed/missed"])
+	r.Equal(0.0, values["clamav_icap_test_passed/missing"])
+	r.NotContains(values, "clamav_icap_test_detected/missing")
+	r.Equal("text/plain", f.contentType())
+}
+
+func TestIcapOptionsValidateTests(t *testing.T) {
+	for _, tc := range []IcapTestCase{
+		{File: "clean.txt", Expect: "clean"},
+		{Name: "eicar", File: "eicar.com", Expect: "infected"},
+		{Name: "clean", Expect: "clean"},
+		{Name: "clean", File: "clean.txt", Expect: "harmless"},
+		{Name: "clean", File: "clean.txt", Expect: "clean", Signature: "Eicar-Test-Signature"},
+	} {
+		require.Error(t, IcapOptions{Tests: []IcapTestCase{tc}}.validate(), "%+v", tc)
+	}
+	require.Error(t, IcapOptions{Tests: []IcapTestCase{
+		{Name: "a", File: "a", Expect: "clean"},
+		{Name: "a", File: "b", Expect: "clean"},
+	}}.validate())
+}
+
+func TestIcapCheckerPreview(t *testing.T) {
+	r := require.New(t)
+	f := newFakeIcap(t)
+	defer f.Close()
+
+	gather := func(opts IcapOptions) map[string]float64 {
+		return gatherMetrics(t, NewIcapChecker("", opts), "probe", "path", "phase")
+	}
+
+	opts := f.options()
+	opts.Preview = true
+
+	// both streams fit into the preview
+	values := gather(opts)
+	r.Equal(1.0, values["clamav_icap_eicar_detected"])
+	r.Equal(1.0, values["clamav_icap_hello_ok"])
+	r.Equal(1.0, values["clamav_icap_path/eicar/preview"])
+	r.Equal(0.0, values["clamav_icap_path/eicar/continue"])
+	r.Contains(values, "clamav_icap_phase_seconds/eicar/connect")
+	r.Contains(values, "clamav_icap_phase_seconds/eicar/preview")
+	r.NotContains(values, "clamav_icap_phase_seconds/eicar/response")
+
+	// the service asks for the rest of the body
+	f.setPreview("16", false)
+	values = gather(opts)
+	r.Equal(1.0, values["clamav_icap_eicar_detected"])
+	r.Equal(1.0, values["clamav_icap_hello_ok"])
+	r.Equal(1.0, values["clamav_icap_path/eicar/continue"])
+	r.Equal(1.0, values["clamav_icap_path/hello/continue"])
+	r.Contains(values, "clamav_icap_phase_seconds/eicar/response")
+
+	// the service answers the preview with 204
+	f.setPreview("16", true)
+	values = gather(opts)
+	r.Equal(1.0, values["clamav_icap_up"])
+	r.Equal(0.0, values["clamav_icap_eicar_detected"])
+	r.Equal(204.0, values["clamav_icap_eicar_icap_code"])
+	r.Equal(1.0, values["clamav_icap_path/eicar/preview"])
+
+	// without Preview in the OPTIONS response the full body is sent
+	f.setPreview("", false)
+	values = gather(opts)
+	r.Equal(1.0, values["clamav_icap_eicar_detected"])
+	r.Equal(1.0, values["clamav_icap_path/eicar/full"])
+	r.Contains(values, "clamav_icap_phase_seconds/eicar/response")
+}
+
+func TestIcapCheckerKeepAlive(t *testing.T) {
+	r := require.New(t)
+	f := newFakeIcap(t)
+	defer f.Close()
+
+	gather := func(opts IcapOptions) map[string]float64 {
+		return gatherMetrics(t, NewIcapChecker("", opts), "probe")
+	}
+	connections := func() int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		n := f.connections
+		f.connections = 0
+		return n
+	}
+
+	opts := f.options()
+	values := gather(opts)
+	r.Equal(3, connections())
+	r.Contains(values, "clamav_icap_request_seconds/eicar")
+	r.NotContains(values, "clamav_icap_connection_reused/eicar")
+	r.NotContains(values, "clamav_icap_connections_opened")
+
+	// eicar, hello and options over a single connection, with a preview
+	// which is answered with 100 Continue
+	opts.KeepAlive = true
+	opts.Preview = true
+	f.setPreview("16", false)
+	values = gather(opts)
+	r.Equal(1, connections())
+	r.Equal(1.0, values["clamav_icap_up"])
+	r.Equal(1.0, values["clamav_icap_eicar_detected"])
+	r.Equal(1.0, values["clamav_icap_hello_ok"])
+	r.Equal(200.0, values["clamav_icap_options_status_code"])
+	r.Equal(1.0, values["clamav_icap_connections_opened"])
+	r.Equal(0.0, values["clamav_icap_connection_reuse_failures"])
+	// only the first request opened the connection, which might have been
+	// the OPTIONS request for the preview size
+	reused := values["clamav_icap_connection_reused/eicar"] + values["clamav_icap_connection_reused/hello"] + values["clamav_icap_connection_reused/options"]
+	r.True(reused >= 2, "%v", reused)
+	r.Contains(values, "clamav_icap_request_seconds/hello")
+
+	// the service closes the connection after every second request, the
+	// request which failed is retried over a new connection
+	f.mu.Lock()
+	f.maxRequests = 2
+	f.mu.Unlock()
+	opts.Preview = false
+	values = gather(opts)
+	r.Equal(2, connections())
+	r.Equal(1.0, values["clamav_icap_eicar_detected"])
+	r.Equal(1.0, values["clamav_icap_hello_ok"])
+	r.Equal(200.0, values["clamav_icap_options_status_code"])
+	r.Equal(2.0, values["clamav_icap_connections_opened"])
+	r.Equal(1.0, values["clamav_icap_connection_reuse_failures"])
+}
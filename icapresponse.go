@@ -0,0 +1,312 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+const (
+	// icapMaxBodySize limits the encapsulated body which is read, e.g. of a
+	// block page
+	icapMaxBodySize = 1 << 20
+	// icapMaxHeaderSize limits an encapsulated HTTP header, whose size is
+	// taken from the offsets in the Encapsulated header of the service
+	icapMaxHeaderSize = 64 << 10
+)
+
+// icapEncapsulated is an entity of the Encapsulated header, e.g. res-hdr=0.
+type icapEncapsulated struct {
+	Name   string
+	Offset int
+}
+
+// icapHTTPMessage is an encapsulated HTTP request or response header.
+type icapHTTPMessage struct {
+	// StartLine is the request or status line
+	StartLine string
+	Header    textproto.MIMEHeader
+}
+
+// code returns the status code of an HTTP response, or 0.
+func (m *icapHTTPMessage) code() int {
+	if m == nil {
+		return 0
+	}
+	f := strings.Fields(m.StartLine)
+	if len(f) < 2 || !strings.HasPrefix(f[0], "HTTP/") {
+		return 0
+	}
+	code, _ := strconv.Atoi(f[1])
+	return code
+}
+
+// icapResponse is an ICAP/1.0 response, see
+// https://tools.ietf.org/html/rfc3507#section-4.3.3 and section 4.4.
+type icapResponse struct {
+	Code         int
+	Status       string
+	Header       textproto.MIMEHeader
+	Encapsulated []icapEncapsulated
+
+	// the encapsulated HTTP messages, nil if not present
+	HTTPRequest  *icapHTTPMessage
+	HTTPResponse *icapHTTPMessage
+	// Body is the de-chunked req-body, res-body or opt-body
+	Body []byte
+	// Violations are listed in the X-Violations-Found header
+	Violations []icapViolation
+}
+
+// icapViolation is a threat reported by the X-Violations-Found header, which
+// lists the fields of every violation on continuation lines of their own.
+type icapViolation struct {
+	Filename   string
+	Threat     string
+	ID         string
+	Resolution string
+}
+
+// parseIcapViolations parses the X-Violations-Found header from the raw
+// header lines, textproto joins the continuation lines and thereby loses the
+// boundaries of fields with spaces, like the threat "EICAR Test String".
+func parseIcapViolations(lines []string) (violations []icapViolation) {
+	var fields []string
+	found := false
+	for _, l := range lines {
+		if l != "" && (l[0] == ' ' || l[0] == '\t') {
+			if found {
+				fields = append(fields, strings.TrimSpace(l))
+			}
+			continue
+		}
+		kv := strings.SplitN(l, ":", 2)
+		found = len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "X-Violations-Found")
+	}
+	for len(fields) >= 4 {
+		violations = append(violations, icapViolation{fields[0], fields[1], fields[2], fields[3]})
+		fields = fields[4:]
+	}
+	return
+}
+
+// parseIcapEncapsulated parses an Encapsulated header like
+// "res-hdr=0, res-body=137".
+func parseIcapEncapsulated(value string) (entities []icapEncapsulated, err error) {
+	last := -1
+	for _, part := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid Encapsulated header %q", value)
+		}
+		switch kv[0] {
+		case "req-hdr", "res-hdr", "req-body", "res-body", "null-body", "opt-body":
+		default:
+			return nil, fmt.Errorf("invalid Encapsulated entity %q", kv[0])
+		}
+		offset, err := strconv.Atoi(kv[1])
+		if err != nil || offset < last {
+			return nil, fmt.Errorf("invalid Encapsulated header %q", value)
+		}
+		last = offset
+		entities = append(entities, icapEncapsulated{kv[0], offset})
+	}
+	return
+}
+
+// readIcapResponse reads a complete ICAP response including the encapsulated
+// HTTP headers and body, so that the connection could be reused afterwards.
+func readIcapResponse(r *bufio.Reader) (*icapResponse, error) {
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	f := strings.SplitN(line, " ", 3)
+	if len(f) < 2 || !strings.HasPrefix(f[0], "ICAP/") {
+		return nil, fmt.Errorf("invalid ICAP status line %q", line)
+	}
+	res := &icapResponse{}
+	if res.Code, err = strconv.Atoi(f[1]); err != nil {
+		return nil, fmt.Errorf("invalid ICAP status line %q", line)
+	}
+	if len(f) == 3 {
+		res.Status = f[2]
+	}
+	var lines []string
+	for {
+		l, err := tp.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if l == "" {
+			break
+		}
+		lines = append(lines, l)
+	}
+	raw := strings.Join(append(lines, "", ""), "\r\n")
+	if res.Header, err = textproto.NewReader(bufio.NewReader(strings.NewReader(raw))).ReadMIMEHeader(); err != nil {
+		return nil, err
+	}
+	res.Violations = parseIcapViolations(lines)
+
+	// interim and unmodified responses carry no encapsulated message
+	if res.Code == 100 || res.Code == 204 {
+		return res, nil
+	}
+	encapsulated := res.Header.Get("Encapsulated")
+	if encapsulated == "" {
+		return res, nil
+	}
+	if res.Encapsulated, err = parseIcapEncapsulated(encapsulated); err != nil {
+		return nil, err
+	}
+
+	for i, e := range res.Encapsulated {
+		switch e.Name {
+		case "req-hdr", "res-hdr":
+			if i+1 == len(res.Encapsulated) {
+				return nil, fmt.Errorf("encapsulated %s lacks a body entity in %q", e.Name, encapsulated)
+			}
+			size := res.Encapsulated[i+1].Offset - e.Offset
+			if size > icapMaxHeaderSize {
+				return nil, fmt.Errorf("encapsulated %s exceeds %d bytes", e.Name, icapMaxHeaderSize)
+			}
+			raw := make([]byte, size)
+			if _, err := io.ReadFull(r, raw); err != nil {
+				return nil, fmt.Errorf("failed to read encapsulated %s: %w", e.Name, err)
+			}
+			msg, err := parseIcapHTTPMessage(raw)
+			if err != nil {
+				return nil, err
+			}
+			if e.Name == "req-hdr" {
+				res.HTTPRequest = msg
+			} else {
+				res.HTTPResponse = msg
+			}
+		case "req-body", "res-body", "opt-body":
+			if res.Body, err = readIcapChunked(r); err != nil {
+				return nil, fmt.Errorf("failed to read encapsulated %s: %w", e.Name, err)
+			}
+		}
+	}
+	return res, nil
+}
+
+func parseIcapHTTPMessage(raw []byte) (*icapHTTPMessage, error) {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("invalid encapsulated HTTP header: %v", err)
+	}
+	hdr, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid encapsulated HTTP header: %v", err)
+	}
+	return &icapHTTPMessage{StartLine: line, Header: hdr}, nil
+}
+
+// readIcapChunked reads a chunked body up to and including the terminating
+// zero length chunk. Chunk extensions like ieof are ignored.
+func readIcapChunked(r *bufio.Reader) ([]byte, error) {
+	tp := textproto.NewReader(r)
+	var body []byte
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		sizeStr := strings.TrimSpace(strings.SplitN(line, ";", 2)[0])
+		size, err := strconv.ParseInt(sizeStr, 16, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid chunk size %q", line)
+		}
+		if size == 0 {
+			// optional trailer headers end with an empty line
+			if _, err := tp.ReadMIMEHeader(); err != nil {
+				return nil, err
+			}
+			return body, nil
+		}
+		if int64(len(body))+size > icapMaxBodySize {
+			return nil, fmt.Errorf("encapsulated body exceeds %d bytes", icapMaxBodySize)
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(chunk, []byte("\r\n")) {
+			return nil, fmt.Errorf("chunk of %d bytes is not terminated by CRLF", size)
+		}
+		body = append(body, chunk[:size]...)
+	}
+}
+
+// ServerVersion returns the version of a c-icap server, or the Server header
+// of any other server.
+func (res *icapResponse) ServerVersion() string {
+	server := res.Header.Get("Server")
+	if strings.HasPrefix(server, "C-ICAP/") {
+		return strings.TrimPrefix(server, "C-ICAP/")
+	}
+	return server
+}
+
+// Threat reports whether the service has found a threat and its name, if it
+// is known. The infection headers of c-icap (X-Infection-Found), Symantec
+// (X-Violations-Found) and others (X-Virus-ID) are recognised.
+func (res *icapResponse) Threat() (found bool, name string) {
+	if v := res.Header.Get("X-Infection-Found"); v != "" {
+		for _, param := range strings.Split(v, ";") {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "Threat") {
+				name = kv[1]
+			}
+		}
+		return true, name
+	}
+	if v := res.Header.Get("X-Violations-Found"); v != "" {
+		// the count is followed by the violations on continuation lines
+		f := strings.Fields(v)
+		if n, err := strconv.Atoi(f[0]); err == nil && n > 0 {
+			if len(res.Violations) > 0 {
+				name = res.Violations[0].Threat
+			}
+			return true, name
+		}
+	}
+	if v := strings.TrimSpace(res.Header.Get("X-Virus-ID")); v != "" {
+		return true, v
+	}
+	return false, ""
+}
+
+// Detected reports whether the scanned message has been recognised as a
+// threat, either by an infection header or because it has been blocked.
+func (res *icapResponse) Detected(method string) bool {
+	found, _ := res.Threat()
+	return found || res.Blocked(method)
+}
+
+// Blocked reports whether a scanned message has been blocked, even without
+// any infection header: a REQMOD request is blocked if the service answers
+// with an HTTP response instead of the (modified) request, a RESPMOD response
+// if the service replaced it with an error or a redirect.
+func (res *icapResponse) Blocked(method string) bool {
+	if res.Code != 200 {
+		return false
+	}
+	if method == "REQMOD" {
+		return res.HTTPResponse != nil
+	}
+	code := res.HTTPResponse.code()
+	return code != 0 && (code < 200 || code > 299)
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIcapEncapsulated(t *testing.T) {
+	r := require.New(t)
+
+	e, err := parseIcapEncapsulated("res-hdr=0, res-body=137")
+	r.NoError(err)
+	r.Equal([]icapEncapsulated{{"res-hdr", 0}, {"res-body", 137}}, e)
+
+	for _, v := range []string{"res-hdr", "res-hdr=0, res-body=x", "res-hdr=10, res-body=5", "foo-body=0"} {
+		_, err = parseIcapEncapsulated(v)
+		r.Error(err, v)
+	}
+}
+
+func TestParseIcapViolations(t *testing.T) {
+	r := require.New(t)
+
+	r.Equal([]icapViolation{
+		{"my eicar file.com", "EICAR Test String", "11101", "2"},
+		{"other.zip", "W32.Foo", "123", "0"},
+	}, parseIcapViolations([]string{
+		"Server: Symantec Scan Engine/5.2",
+		"X-Violations-Found: 2",
+		"\tmy eicar file.com",
+		"\tEICAR Test String",
+		"\t11101",
+		"\t2",
+		" other.zip",
+		" W32.Foo",
+		" 123",
+		" 0",
+		"Encapsulated: res-hdr=0, null-body=19",
+	}))
+	r.Empty(parseIcapViolations([]string{"X-Violations-Found: 0"}))
+}
+
+func TestReadIcapResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		method   string
+		res      string
+		code     int
+		server   string
+		threat   string
+		detected bool
+		body     string
+	}{
+		{
+			name:   "c-icap infection found",
+			method: "RESPMOD",
+			res: "ICAP/1.0 200 OK\r\n" +
+				"Server: C-ICAP/0.5.6\r\n" +
+				"Connection: keep-alive\r\n" +
+				"ISTag: \"CI0001-2-squidclamav-10\"\r\n" +
+				"X-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Test-Signature;\r\n" +
+				"Encapsulated: res-hdr=0, res-body=105\r\n\r\n" +
+				"HTTP/1.0 307 Temporary Redirect\r\n" +
+				"Location: http://proxy/cgi-bin/clwarn.cgi?virus=Eicar-Test-Signature\r\n\r\n" +
+				"0\r\n\r\n",
+			code:     200,
+			server:   "0.5.6",
+			threat:   "Eicar-Test-Signature",
+			detected: true,
+		},
+		{
+			name:   "block page",
+			method: "RESPMOD",
+			res: "ICAP/1.0 200 OK\r\n" +
+				"Server: C-ICAP/0.5.6\r\n" +
+				"Encapsulated: res-hdr=0, res-body=67\r\n\r\n" +
+				"HTTP/1.1 403 Forbidden\r\n" +
+				"Content-Type: text/html\r\n" +
+				"Server: C-ICAP\r\n\r\n" +
+				"a\r\n<html>Viru\r\n" +
+				"b; ieof\r\ns found</h>\r\n" +
+				"0\r\n\r\n",
+			code:     200,
+			server:   "0.5.6",
+			detected: true,
+			body:     "<html>Virus found</h>",
+		},
+		{
+			name:   "unmodified",
+			method: "RESPMOD",
+			res: "ICAP/1.0 204 Unmodified\r\n" +
+				"Server: C-ICAP/0.5.6\r\n" +
+				"ISTag: \"CI0001-2-squidclamav-10\"\r\n" +
+				"Encapsulated: null-body=0\r\n\r\n",
+			code:   204,
+			server: "0.5.6",
+		},
+		{
+			name:   "response passed",
+			method: "RESPMOD",
+			res: "ICAP/1.0 200 OK\r\n" +
+				"Server: Proxy-ICAP/2.1\r\n" +
+				"Encapsulated: res-hdr=0, res-body=38\r\n\r\n" +
+				"HTTP/1.1 200 OK\r\n" +
+				"Content-Length: 5\r\n\r\n" +
+				"5\r\nhello\r\n0\r\n\r\n",
+			code:   200,
+			server: "Proxy-ICAP/2.1",
+			body:   "hello",
+		},
+		{
+			name:   "infection without threat name",
+			method: "RESPMOD",
+			res: "ICAP/1.0 200 OK\r\n" +
+				"X-Infection-Found: Type=0; Resolution=2\r\n" +
+				"Encapsulated: res-hdr=0, null-body=19\r\n\r\n" +
+				"HTTP/1.1 200 OK\r\n\r\n",
+			code:     200,
+			detected: true,
+		},
+		{
+			name:   "violations found",
+			method: "RESPMOD",
+			res: "ICAP/1.0 200 OK\r\n" +
+				"Server: Symantec Scan Engine/5.2\r\n" +
+				"X-Violations-Found: 1\r\n" +
+				"\teicar.com\r\n" +
+				"\tEICAR Test String\r\n" +
+				"\t11101\r\n" +
+				"\t2\r\n" +
+				"Encapsulated: res-hdr=0, null-body=19\r\n\r\n" +
+				"HTTP/1.1 200 OK\r\n\r\n",
+			code:     200,
+			server:   "Symantec Scan Engine/5.2",
+			threat:   "EICAR Test String",
+			detected: true,
+		},
+		{
+			name:   "no violations found",
+			method: "RESPMOD",
+			res: "ICAP/1.0 200 OK\r\n" +
+				"X-Violations-Found: 0\r\n" +
+				"Encapsulated: res-hdr=0, null-body=19\r\n\r\n" +
+				"HTTP/1.1 200 OK\r\n\r\n",
+			code: 200,
+		},
+		{
+			name:   "virus id",
+			method: "RESPMOD",
+			res: "ICAP/1.0 200 OK\r\n" +
+				"X-Virus-ID: EICAR_TEST_FILE\r\n" +
+				"Encapsulated: res-hdr=0, null-body=19\r\n\r\n" +
+				"HTTP/1.1 200 OK\r\n\r\n",
+			code:     200,
+			threat:   "EICAR_TEST_FILE",
+			detected: true,
+		},
+		{
+			name:   "request passed",
+			method: "REQMOD",
+			res: "ICAP/1.0 200 OK\r\n" +
+				"Encapsulated: req-hdr=0, req-body=44\r\n\r\n" +
+				"POST /upload HTTP/1.1\r\n" +
+				"Content-Length: 5\r\n\r\n" +
+				"5\r\nhello\r\n0\r\n\r\n",
+			code: 200,
+			body: "hello",
+		},
+		{
+			name:   "request blocked",
+			method: "REQMOD",
+			res: "ICAP/1.0 200 OK\r\n" +
+				"Encapsulated: res-hdr=0, null-body=26\r\n\r\n" +
+				"HTTP/1.1 403 Forbidden\r\n\r\n",
+			code:     200,
+			detected: true,
+		},
+		{
+			name:   "request unmodified",
+			method: "REQMOD",
+			res: "ICAP/1.0 204 Unmodified\r\n" +
+				"Encapsulated: null-body=0\r\n\r\n",
+			code: 204,
+		},
+		{
+			name:   "service not found",
+			method: "RESPMOD",
+			res:    "ICAP/1.0 404 ICAP Service not found\r\n\r\n",
+			code:   404,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := require.New(t)
+			br := bufio.NewReader(strings.NewReader(tc.res))
+			res, err := readIcapResponse(br)
+			r.NoError(err)
+			r.Equal(tc.code, res.Code)
+			r.Equal(tc.server, res.ServerVersion())
+			_, threat := res.Threat()
+			r.Equal(tc.threat, threat)
+			r.Equal(tc.detected, res.Detected(tc.method))
+			r.Equal(tc.body, string(res.Body))
+			// the whole response has been consumed
+			r.Equal(0, br.Buffered())
+		})
+	}
+}
+
+func TestReadIcapResponseInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		res  string
+	}{
+		{"empty", ""},
+		{"http", "HTTP/1.1 200 OK\r\n\r\n"},
+		{"status code", "ICAP/1.0 OK\r\n\r\n"},
+		{"truncated header", "ICAP/1.0 200 OK\r\nServer: C-ICAP/0.5.6\r\n"},
+		{"encapsulated", "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr\r\n\r\n"},
+		{"missing body entity", "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0\r\n\r\nHTTP/1.1 200 OK\r\n\r\n"},
+		{"truncated http header", "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, null-body=19\r\n\r\nHTTP/1.1 200"},
+		{"chunk size", "ICAP/1.0 200 OK\r\nEncapsulated: res-body=0\r\n\r\nfoo\r\n"},
+		{"truncated chunk", "ICAP/1.0 200 OK\r\nEncapsulated: res-body=0\r\n\r\n10\r\nhello"},
+		{"unterminated chunk", "ICAP/1.0 200 OK\r\nEncapsulated: res-body=0\r\n\r\n5\r\nhello!!0\r\n\r\n"},
+		{"missing last chunk", "ICAP/1.0 200 OK\r\nEncapsulated: res-body=0\r\n\r\n5\r\nhello\r\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := readIcapResponse(bufio.NewReader(strings.NewReader(tc.res)))
+			require.Error(t, err)
+		})
+	}
+	// the header is rejected before its buffer is allocated
+	_, err := readIcapResponse(bufio.NewReader(strings.NewReader("ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, res-body=2000000000\r\n\r\nHTTP/1.1 200 OK\r\n\r\n")))
+	require.EqualError(t, err, "encapsulated res-hdr exceeds 65536 bytes")
+}
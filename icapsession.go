@@ -0,0 +1,157 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// icapSession provides the connections for the requests of a single scrape.
+// With KeepAlive all requests share a persistent connection and are sent one
+// after another, like squid reuses its connections to c-icap. Otherwise every
+// request opens its own connection.
+type icapSession struct {
+	c *IcapChecker
+
+	// mu serialises the requests over the persistent connection
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	// connTLS is the state of conn, if it uses TLS
+	connTLS *tlsState
+	// served is the number of requests answered over conn
+	served int
+
+	// statsMu protects the statistics of all connections of the session
+	statsMu sync.Mutex
+	opened  int
+	// reuseFailures counts how often the service closed the persistent
+	// connection instead of answering the next request
+	reuseFailures int
+}
+
+func (c *IcapChecker) newSession() *icapSession {
+	return &icapSession{c: c}
+}
+
+// Close closes the persistent connection, if any.
+func (s *icapSession) Close() {
+	s.mu.Lock()
+	s.closeConn()
+	s.mu.Unlock()
+}
+
+func (s *icapSession) closeConn() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn, s.r, s.connTLS = nil, nil, nil
+	}
+}
+
+// dial connects to the service, over TLS if enabled, and records the state of
+// the TLS connection in the trace.
+func (s *icapSession) dial(ctx context.Context, trace *icapTrace) (net.Conn, *bufio.Reader, error) {
+	trace.start()
+	conn, state, err := dialTLS(ctx, "tcp", net.JoinHostPort(s.c.opts.Host, s.c.opts.Port), s.c.opts.Timeouts, s.c.opts.TLS)
+	if err != nil {
+		return nil, nil, err
+	}
+	trace.phase("connect")
+	trace.tls = state
+
+	s.statsMu.Lock()
+	s.opened++
+	s.statsMu.Unlock()
+	return conn, bufio.NewReader(conn), nil
+}
+
+// roundTrip sends a request with send, which returns the final response. A
+// request over a persistent connection which has been closed by the service
+// in the meantime is retried once over a new connection.
+func (s *icapSession) roundTrip(ctx context.Context, trace *icapTrace, send func(conn net.Conn, r *bufio.Reader) (*icapResponse, error)) (*icapResponse, error) {
+	if !s.c.opts.KeepAlive {
+		start := time.Now()
+		defer func() {
+			trace.elapsed = time.Since(start).Seconds()
+		}()
+		conn, r, err := s.dial(ctx, trace)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return s.send(ctx, conn, r, trace, send)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := time.Now()
+	defer func() {
+		trace.elapsed = time.Since(start).Seconds()
+	}()
+	for retried := false; ; retried = true {
+		if s.conn == nil {
+			conn, r, err := s.dial(ctx, trace)
+			if err != nil {
+				return nil, err
+			}
+			s.conn, s.r, s.connTLS, s.served = conn, r, trace.tls, 0
+		}
+		trace.reused = s.served > 0
+		trace.tls = s.connTLS
+		res, err := s.send(ctx, s.conn, s.r, trace, send)
+		if err != nil {
+			s.closeConn()
+			if trace.reused && !retried && isConnClosed(err) {
+				s.statsMu.Lock()
+				s.reuseFailures++
+				s.statsMu.Unlock()
+				trace.phases = nil
+				continue
+			}
+			return nil, err
+		}
+		s.served++
+		if strings.EqualFold(res.Header.Get("Connection"), "close") {
+			s.closeConn()
+		}
+		return res, nil
+	}
+}
+
+func (s *icapSession) send(ctx context.Context, conn net.Conn, r *bufio.Reader, trace *icapTrace, send func(conn net.Conn, r *bufio.Reader) (*icapResponse, error)) (*icapResponse, error) {
+	if err := conn.SetDeadline(deadline(ctx, s.c.opts.Timeouts.Read.Duration)); err != nil {
+		return nil, err
+	}
+	trace.start()
+	start := time.Now()
+	res, err := send(conn, r)
+	if err != nil {
+		return nil, err
+	}
+	trace.request = time.Since(start)
+	trace.answered = true
+	return res, nil
+}
+
+// stats returns the number of connections opened and the number of failed
+// reuses.
+func (s *icapSession) stats() (opened, reuseFailures int) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	return s.opened, s.reuseFailures
+}
+
+// isConnClosed reports whether err has been caused by a connection which the
+// peer has closed.
+func isConnClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
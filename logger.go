@@ -0,0 +1,213 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLogRepeatInterval = 5 * time.Minute
+	// logRepeatPruneSize is the number of rate-limited messages after which
+	// expired ones are forgotten
+	logRepeatPruneSize = 1024
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	if s == "" {
+		return levelInfo, nil
+	}
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q", s)
+}
+
+// LogOptions configure the log of the exporter, which is written to stderr.
+type LogOptions struct {
+	// Level is the minimum level which is logged: debug, info (default),
+	// warn or error
+	Level string `json:"level"`
+	// Format is either logfmt (default) or json
+	Format string `json:"format"`
+	// RepeatInterval is the interval in which identical errors are logged
+	// only once (default 5m)
+	RepeatInterval Duration `json:"repeat_interval"`
+}
+
+// logRepeat tracks a rate-limited message.
+type logRepeat struct {
+	last       time.Time
+	suppressed int
+}
+
+// structuredLogger writes one line of key value pairs per message, either in
+// logfmt or as JSON object.
+type structuredLogger struct {
+	mu      sync.Mutex
+	w       io.Writer
+	level   logLevel
+	json    bool
+	repeat  time.Duration
+	now     func() time.Time
+	repeats map[string]*logRepeat
+}
+
+func newStructuredLogger(w io.Writer, opts LogOptions) (*structuredLogger, error) {
+	level, err := parseLogLevel(opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	l := &structuredLogger{
+		w:       w,
+		level:   level,
+		repeat:  opts.RepeatInterval.Duration,
+		now:     time.Now,
+		repeats: make(map[string]*logRepeat),
+	}
+	switch opts.Format {
+	case "", "logfmt":
+	case "json":
+		l.json = true
+	default:
+		return nil, fmt.Errorf("invalid log format %q", opts.Format)
+	}
+	if l.repeat <= 0 {
+		l.repeat = defaultLogRepeatInterval
+	}
+	return l, nil
+}
+
+// logger is used by all checkers, it is replaced once the configuration has
+// been read.
+var logger, _ = newStructuredLogger(os.Stderr, LogOptions{})
+
+func (l *structuredLogger) Debug(msg string, kv ...interface{}) { l.log(levelDebug, "", msg, kv) }
+func (l *structuredLogger) Info(msg string, kv ...interface{})  { l.log(levelInfo, "", msg, kv) }
+func (l *structuredLogger) Warn(msg string, kv ...interface{})  { l.log(levelWarn, "", msg, kv) }
+func (l *structuredLogger) Error(msg string, kv ...interface{}) { l.log(levelError, "", msg, kv) }
+
+// Limited logs a message at most once per repeat interval for the same key.
+// The number of suppressed messages is added as repeated to the next one.
+func (l *structuredLogger) Limited(level logLevel, key, msg string, kv ...interface{}) {
+	l.log(level, key, msg, kv)
+}
+
+func (l *structuredLogger) log(level logLevel, key, msg string, kv []interface{}) {
+	if level < l.level {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if key != "" {
+		key = level.String() + "\x00" + msg + "\x00" + key
+		r, ok := l.repeats[key]
+		if ok && now.Sub(r.last) < l.repeat {
+			r.suppressed++
+			return
+		}
+		if !ok {
+			l.pruneRepeats(now)
+			r = &logRepeat{}
+			l.repeats[key] = r
+		}
+		if r.suppressed > 0 {
+			kv = append(kv, "repeated", r.suppressed)
+		}
+		r.last, r.suppressed = now, 0
+	}
+
+	fields := append([]interface{}{
+		"ts", now.UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		"level", level.String(),
+		"msg", msg,
+	}, kv...)
+	var buf bytes.Buffer
+	if l.json {
+		writeJSONFields(&buf, fields)
+	} else {
+		writeLogfmtFields(&buf, fields)
+	}
+	buf.WriteByte('\n')
+	l.w.Write(buf.Bytes())
+}
+
+func (l *structuredLogger) pruneRepeats(now time.Time) {
+	if len(l.repeats) < logRepeatPruneSize {
+		return
+	}
+	for key, r := range l.repeats {
+		if now.Sub(r.last) >= l.repeat {
+			delete(l.repeats, key)
+		}
+	}
+}
+
+func formatLogValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func writeLogfmtFields(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i+1 < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(formatLogValue(fields[i]))
+		buf.WriteByte('=')
+		v := formatLogValue(fields[i+1])
+		if v == "" || strings.ContainsAny(v, " =\"\t\r\n\\") {
+			v = strconv.Quote(v)
+		}
+		buf.WriteString(v)
+	}
+}
+
+func writeJSONFields(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i+1 < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(formatLogValue(fields[i]))
+		v, _ := json.Marshal(formatLogValue(fields[i+1]))
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+}
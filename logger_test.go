@@ -0,0 +1,87 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLogger(t *testing.T, opts LogOptions) (*structuredLogger, *bytes.Buffer, *time.Time) {
+	var buf bytes.Buffer
+	l, err := newStructuredLogger(&buf, opts)
+	require.NoError(t, err)
+	now := time.Date(2020, 1, 24, 10, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	return l, &buf, &now
+}
+
+func TestLoggerLogfmt(t *testing.T) {
+	r := require.New(t)
+	l, buf, _ := newTestLogger(t, LogOptions{})
+
+	l.Debug("hidden")
+	l.Error("probe failed",
+		"target", "tcp://127.0.0.1:3310",
+		"probe", "eicar",
+		"duration", 1500*time.Millisecond,
+		"err", errors.New(`clamd INSTREAM failed: "stream" ERROR`),
+		"empty", "")
+	r.Equal(`ts=2020-01-24T10:00:00.000Z level=error msg="probe failed" target=tcp://127.0.0.1:3310 probe=eicar duration=1.5s err="clamd INSTREAM failed: \"stream\" ERROR" empty=""`+"\n", buf.String())
+}
+
+func TestLoggerJSON(t *testing.T) {
+	r := require.New(t)
+	l, buf, _ := newTestLogger(t, LogOptions{Level: "debug", Format: "json"})
+
+	l.Debug("probe", "probe", "version", "duration", time.Second)
+	var fields map[string]string
+	r.NoError(json.Unmarshal(buf.Bytes(), &fields))
+	r.Equal(map[string]string{
+		"ts":       "2020-01-24T10:00:00.000Z",
+		"level":    "debug",
+		"msg":      "probe",
+		"probe":    "version",
+		"duration": "1s",
+	}, fields)
+}
+
+func TestLoggerOptions(t *testing.T) {
+	r := require.New(t)
+
+	_, err := newStructuredLogger(nil, LogOptions{Level: "verbose"})
+	r.Error(err)
+	_, err = newStructuredLogger(nil, LogOptions{Format: "xml"})
+	r.Error(err)
+
+	l, buf, _ := newTestLogger(t, LogOptions{Level: "WARN"})
+	l.Info("hidden")
+	l.Warn("shown")
+	r.Equal(1, strings.Count(buf.String(), "\n"))
+}
+
+func TestLoggerLimited(t *testing.T) {
+	r := require.New(t)
+	l, buf, now := newTestLogger(t, LogOptions{RepeatInterval: Duration{time.Minute}})
+
+	for i := 0; i < 3; i++ {
+		l.Limited(levelError, "connection refused", "probe failed", "err", "connection refused")
+		*now = now.Add(10 * time.Second)
+	}
+	l.Limited(levelError, "timeout", "probe failed", "err", "timeout")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	r.Len(lines, 2)
+
+	*now = now.Add(time.Minute)
+	l.Limited(levelError, "connection refused", "probe failed", "err", "connection refused")
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	r.Len(lines, 3)
+	r.True(strings.HasSuffix(lines[2], "err=\"connection refused\" repeated=2"), lines[2])
+}
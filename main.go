@@ -4,29 +4,132 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"os"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type Config struct {
-	Listen string `json:"listen"`
-	ClamD  struct {
+	Listen string         `json:"listen"`
+	Log    LogOptions     `json:"log"`
+	ClamD  ClamDInstances `json:"clamd"`
+	Icap   IcapInstances  `json:"icap"`
+	Milter []struct {
+		Name string `json:"name"`
+		MilterOptions
+	} `json:"milter"`
+	Database []struct {
+		Name string `json:"name"`
+		DatabaseOptions
+	} `json:"database"`
+	Freshclam []struct {
+		Name string `json:"name"`
+		FreshclamOptions
+	} `json:"freshclam"`
+	Modules map[string]Module `json:"modules"`
+}
+
+type ClamDInstance struct {
+	Name string `json:"name"`
+	ClamDOptions
+}
+
+// ClamDInstances are the configured clamd checkers. The single object with
+// "enable" of earlier versions is still accepted as one unnamed instance.
+type ClamDInstances []ClamDInstance
+
+func (l *ClamDInstances) UnmarshalJSON(b []byte) error {
+	if !isJSONObject(b) {
+		return json.Unmarshal(b, (*[]ClamDInstance)(l))
+	}
+	var legacy struct {
 		Enable bool `json:"enable"`
 		ClamDOptions
-	} `json:"clamd"`
-	Icap struct {
+	}
+	if err := json.Unmarshal(b, &legacy); err != nil {
+		return err
+	}
+	*l = nil
+	if legacy.Enable {
+		*l = ClamDInstances{{ClamDOptions: legacy.ClamDOptions}}
+	}
+	return nil
+}
+
+type IcapInstance struct {
+	Name string `json:"name"`
+	IcapOptions
+}
+
+// IcapInstances are the configured ICAP checkers. The single object with
+// "enable" of earlier versions is still accepted as one unnamed instance.
+type IcapInstances []IcapInstance
+
+func (l *IcapInstances) UnmarshalJSON(b []byte) error {
+	if !isJSONObject(b) {
+		return json.Unmarshal(b, (*[]IcapInstance)(l))
+	}
+	var legacy struct {
 		Enable bool `json:"enable"`
 		IcapOptions
-	} `json:"icap"`
+	}
+	if err := json.Unmarshal(b, &legacy); err != nil {
+		return err
+	}
+	*l = nil
+	if legacy.Enable {
+		*l = IcapInstances{{IcapOptions: legacy.IcapOptions}}
+	}
+	return nil
+}
+
+func isJSONObject(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	return len(b) > 0 && b[0] == '{'
+}
+
+// writeTimeout returns the write timeout of the HTTP server, which must leave
+// enough time to send the metrics of a scrape that runs into the largest
+// overall timeout of the checkers and modules.
+func (cfg Config) writeTimeout() time.Duration {
+	timeouts := []Timeouts{}
+	for _, inst := range cfg.ClamD {
+		timeouts = append(timeouts, inst.Timeouts)
+	}
+	for _, inst := range cfg.Icap {
+		timeouts = append(timeouts, inst.Timeouts)
+	}
+	for _, inst := range cfg.Milter {
+		timeouts = append(timeouts, inst.Timeouts)
+	}
+	for _, m := range cfg.Modules {
+		timeouts = append(timeouts, m.ClamD.Timeouts, m.Icap.Timeouts, m.Milter.Timeouts)
+	}
+	overall := defaultOverallTimeout
+	for _, t := range timeouts {
+		if t := t.withDefaults().Overall.Duration; t > overall {
+			overall = t
+		}
+	}
+	return overall + writeTimeoutMargin
+}
+
+// instanceLabels returns the const labels which are attached to every metric
+// of a named checker, so that several checkers of the same kind can be
+// registered side by side.
+func instanceLabels(name string) prometheus.Labels {
+	if name == "" {
+		return nil
+	}
+	return prometheus.Labels{"instance_name": name}
 }
 
 func run() error {
@@ -49,22 +152,77 @@ func run() error {
 	if err := json.NewDecoder(cfgFile).Decode(&cfg); err != nil {
 		return fmt.Errorf("failed to decode config %q: %v", *flagConfig, err)
 	}
+	if logger, err = newStructuredLogger(os.Stderr, cfg.Log); err != nil {
+		return fmt.Errorf("invalid log configuration: %v", err)
+	}
 
+	// the checkers are registered in a new registry for every scrape, this
+	// one is only used to detect conflicting checkers at startup
 	registry := prometheus.NewPedanticRegistry()
+	var checkers []contextChecker
 
-	if cfg.ClamD.Enable {
-		log.Println("enabling clamd checker")
-		c := NewClamDChecker(cfg.ClamD.ClamDOptions)
+	for _, inst := range cfg.ClamD {
+		if err := inst.ClamDOptions.validate(); err != nil {
+			return fmt.Errorf("invalid clamd checker %q: %v", inst.Name, err)
+		}
+		logger.Info("enabling checker", "checker", "clamd", "instance", inst.Name, "target", inst.URL)
+		c := NewClamDChecker(inst.Name, inst.ClamDOptions)
 		if err := registry.Register(c); err != nil {
-			return fmt.Errorf("failed to register clamd checker: %v", err)
+			return fmt.Errorf("failed to register clamd checker %q: %v", inst.Name, err)
 		}
-
+		if inst.Background.enabled() {
+			go c.Run(context.Background())
+		}
+		checkers = append(checkers, c)
+	}
+	for _, inst := range cfg.Icap {
+		if err := inst.IcapOptions.validate(); err != nil {
+			return fmt.Errorf("invalid icap checker %q: %v", inst.Name, err)
+		}
+		logger.Info("enabling checker", "checker", "icap", "instance", inst.Name, "target", net.JoinHostPort(inst.Host, inst.Port), "tls", inst.TLS != nil)
+		c := NewIcapChecker(inst.Name, inst.IcapOptions)
+		if err := registry.Register(c); err != nil {
+			return fmt.Errorf("failed to register icap checker %q: %v", inst.Name, err)
+		}
+		if inst.Background.enabled() {
+			go c.Run(context.Background())
+		}
+		checkers = append(checkers, c)
+	}
+	for _, inst := range cfg.Milter {
+		if err := inst.MilterOptions.validate(); err != nil {
+			return fmt.Errorf("invalid milter checker %q: %v", inst.Name, err)
+		}
+		logger.Info("enabling checker", "checker", "milter", "instance", inst.Name, "target", inst.URL)
+		c := NewMilterChecker(inst.Name, inst.MilterOptions)
+		if err := registry.Register(c); err != nil {
+			return fmt.Errorf("failed to register milter checker %q: %v", inst.Name, err)
+		}
+		if inst.Background.enabled() {
+			go c.Run(context.Background())
+		}
+		checkers = append(checkers, c)
 	}
-	if cfg.Icap.Enable {
-		log.Println("enabling icap checker")
-		c := NewIcapChecker(cfg.Icap.IcapOptions)
+	for _, inst := range cfg.Database {
+		logger.Info("enabling checker", "checker", "database", "instance", inst.Name, "target", inst.Dir)
+		c := NewDatabaseChecker(inst.Name, inst.DatabaseOptions)
 		if err := registry.Register(c); err != nil {
-			return fmt.Errorf("failed to register icap checker: %v", err)
+			return fmt.Errorf("failed to register database checker %q: %v", inst.Name, err)
+		}
+		checkers = append(checkers, c)
+	}
+	for _, inst := range cfg.Freshclam {
+		logger.Info("enabling checker", "checker", "freshclam", "instance", inst.Name, "target", inst.LogFile)
+		c := NewFreshclamChecker(inst.Name, inst.FreshclamOptions)
+		if err := registry.Register(c); err != nil {
+			return fmt.Errorf("failed to register freshclam checker %q: %v", inst.Name, err)
+		}
+		checkers = append(checkers, c)
+	}
+
+	for name, m := range cfg.Modules {
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("invalid module %q: %v", name, err)
 		}
 	}
 
@@ -76,13 +234,14 @@ func run() error {
 		return fmt.Errorf("failed to listen at %q: %v", cfg.Listen, err)
 	}
 	defer listen.Close()
-	log.Println("listening on", listen.Addr())
+	logger.Info("listening", "addr", listen.Addr())
 
-	http.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	http.Handle("/metrics", metricsHandler(checkers))
+	http.Handle("/probe", probeHandler(cfg.Modules))
 
 	srv := &http.Server{
 		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		WriteTimeout: cfg.writeTimeout(),
 		IdleTimeout:  5 * time.Minute,
 	}
 	if err := srv.Serve(listen); err != nil {
@@ -93,7 +252,7 @@ func run() error {
 
 func main() {
 	if err := run(); err != nil {
-		log.Printf("Error: %v", err)
+		logger.Error("exiting", "err", err)
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,40 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigInstances(t *testing.T) {
+	r := require.New(t)
+
+	var cfg Config
+	r.NoError(json.Unmarshal([]byte(`{
+		"clamd": [{"name": "inbound", "url": "tcp://127.0.0.1:3310"}],
+		"icap": [{"name": "squid", "host": "127.0.0.1", "service": "avscan"}]
+	}`), &cfg))
+	r.Len(cfg.ClamD, 1)
+	r.Equal("inbound", cfg.ClamD[0].Name)
+	r.Equal("tcp://127.0.0.1:3310", cfg.ClamD[0].URL)
+	r.Len(cfg.Icap, 1)
+	r.Equal("squid", cfg.Icap[0].Name)
+	r.Equal("avscan", cfg.Icap[0].Service)
+
+	// the single objects of earlier versions
+	cfg = Config{}
+	r.NoError(json.Unmarshal([]byte(`{
+		"clamd": {"enable": true, "url": "tcp://127.0.0.1:3310"},
+		"icap": {"enable": false, "host": "127.0.0.1"}
+	}`), &cfg))
+	r.Len(cfg.ClamD, 1)
+	r.Empty(cfg.ClamD[0].Name)
+	r.Equal("tcp://127.0.0.1:3310", cfg.ClamD[0].URL)
+	r.Empty(cfg.Icap)
+
+	r.Error(json.Unmarshal([]byte(`{"clamd": "tcp://127.0.0.1:3310"}`), &cfg))
+}
@@ -0,0 +1,346 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const milterBoundary = "clamav-exporter-boundary"
+
+type MilterOptions struct {
+	URL string `json:"url"`
+	ProbeOptions
+	// From and Rcpt are the envelope addresses of the test messages
+	From string `json:"from"`
+	Rcpt string `json:"rcpt"`
+}
+
+type MilterChecker struct {
+	name string
+	opts MilterOptions
+
+	mu   sync.Mutex
+	last *milterCheckResult
+
+	promMilterUp              *prometheus.Desc
+	promMilterProtocolVersion *prometheus.Desc
+	promMilterAction          *prometheus.Desc
+	promMilterEicarDetected   *prometheus.Desc
+	promMilterCleanAccepted   *prometheus.Desc
+	promMilterRoundTrip       *prometheus.Desc
+	promMilterProbeTimeout    *prometheus.Desc
+	promMilterProbeDuration   *prometheus.Desc
+	promMilterProbeLatency    *prometheus.HistogramVec
+	promMilterLastProbeTime   *prometheus.Desc
+	promMilterProbeAge        *prometheus.Desc
+}
+
+func NewMilterChecker(name string, opts MilterOptions) *MilterChecker {
+	if opts.URL == "" {
+		opts.URL = "unix:///var/run/clamav/clamav-milter.ctl"
+	}
+	if opts.From == "" {
+		opts.From = "clamav-exporter@localhost"
+	}
+	if opts.Rcpt == "" {
+		opts.Rcpt = "postmaster@localhost"
+	}
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	constLabels := instanceLabels(name)
+	return &MilterChecker{
+		name: name,
+		opts: opts,
+		promMilterUp: prometheus.NewDesc(
+			"clamav_milter_up",
+			"option negotiation with the milter is successful",
+			[]string{},
+			constLabels),
+		promMilterProtocolVersion: prometheus.NewDesc(
+			"clamav_milter_protocol_version",
+			"negotiated milter protocol version",
+			[]string{},
+			constLabels),
+		promMilterAction: prometheus.NewDesc(
+			"clamav_milter_action",
+			"action the milter returned for the test message",
+			[]string{"probe", "action"},
+			constLabels),
+		promMilterEicarDetected: prometheus.NewDesc(
+			"clamav_milter_eicar_detected",
+			"message with eicar attachment has been rejected, discarded, quarantined or tagged as infected",
+			[]string{},
+			constLabels),
+		promMilterCleanAccepted: prometheus.NewDesc(
+			"clamav_milter_clean_accepted",
+			"clean message has been accepted and not tagged as infected",
+			[]string{},
+			constLabels),
+		promMilterRoundTrip: prometheus.NewDesc(
+			"clamav_milter_round_trip_seconds",
+			"time from the connect command to the final reply of the milter",
+			[]string{"probe"},
+			constLabels),
+		promMilterProbeTimeout: prometheus.NewDesc(
+			"clamav_milter_probe_timeout",
+			"probe has been aborted because it exceeded its timeout",
+			[]string{"probe"},
+			constLabels),
+		promMilterProbeDuration: prometheus.NewDesc(
+			"clamav_milter_probe_duration_seconds",
+			"time it took to run the probe",
+			[]string{"probe"},
+			constLabels),
+		promMilterProbeLatency: newProbeLatency("milter", opts.LatencyBuckets, constLabels),
+		promMilterLastProbeTime: prometheus.NewDesc(
+			"clamav_milter_last_probe_timestamp_seconds",
+			"unix epoch timestamp of the last probe",
+			[]string{},
+			constLabels),
+		promMilterProbeAge: prometheus.NewDesc(
+			"clamav_milter_probe_age_seconds",
+			"age of the probe results served by this scrape",
+			[]string{},
+			constLabels),
+	}
+}
+
+func (c *MilterChecker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.promMilterUp
+	ch <- c.promMilterProtocolVersion
+	ch <- c.promMilterAction
+	ch <- c.promMilterEicarDetected
+	ch <- c.promMilterCleanAccepted
+	ch <- c.promMilterRoundTrip
+	ch <- c.promMilterProbeTimeout
+	ch <- c.promMilterProbeDuration
+	c.promMilterProbeLatency.Describe(ch)
+	ch <- c.promMilterLastProbeTime
+	ch <- c.promMilterProbeAge
+}
+
+func (c *MilterChecker) Collect(ch chan<- prometheus.Metric) {
+	c.CollectContext(context.Background(), ch)
+}
+
+func (c *MilterChecker) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	if c.opts.Background.enabled() {
+		c.mu.Lock()
+		last := c.last
+		c.mu.Unlock()
+		if last != nil {
+			c.collect(ch, *last)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeouts.Overall.Duration)
+	defer cancel()
+	c.collect(ch, c.probe(ctx))
+}
+
+// Run probes the milter in the background until ctx is done, see BackgroundOptions.
+func (c *MilterChecker) Run(ctx context.Context) {
+	runBackground(ctx, c.opts.Background, func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, c.opts.Timeouts.Overall.Duration)
+		defer cancel()
+		res := c.probe(ctx)
+
+		c.mu.Lock()
+		c.last = &res
+		c.mu.Unlock()
+	})
+}
+
+// milterTransactionResult is the outcome of a single test message.
+type milterTransactionResult struct {
+	negotiated bool
+	version    uint32
+	result     milterResult
+	roundTrip  float64
+}
+
+// milterCheckResult holds the outcome of all probes of a single scrape.
+type milterCheckResult struct {
+	eicar  milterTransactionResult
+	clean  milterTransactionResult
+	probes []probeStatus
+	time   time.Time
+}
+
+func (c *MilterChecker) probe(ctx context.Context) (res milterCheckResult) {
+	res.time = time.Now()
+	res.eicar.roundTrip = math.NaN()
+	res.clean.roundTrip = math.NaN()
+	res.probes = runProbes(ctx, c.opts.Parallelism, []probe{
+		{"eicar", func(ctx context.Context) error {
+			return c.transaction(ctx, milterTestMessage(c.opts.From, c.opts.Rcpt, eicar), &res.eicar)
+		}},
+		{"clean", func(ctx context.Context) error {
+			return c.transaction(ctx, milterTestMessage(c.opts.From, c.opts.Rcpt, nil), &res.clean)
+		}},
+	})
+	logProbeErrors("milter", c.name, c.opts.URL, res.probes)
+	observeProbes(c.promMilterProbeLatency, res.probes)
+	return
+}
+
+// transaction sends msg over a new connection to the milter.
+func (c *MilterChecker) transaction(ctx context.Context, msg milterMessage, res *milterTransactionResult) error {
+	cl, err := dialMilter(ctx, c.opts.URL, c.opts.Timeouts)
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+
+	if err := cl.Negotiate(); err != nil {
+		return err
+	}
+	res.negotiated = true
+	res.version = cl.Version()
+
+	start := time.Now()
+	if res.result, err = cl.Transaction(msg); err != nil {
+		return err
+	}
+	res.roundTrip = time.Since(start).Seconds()
+	cl.Quit()
+	return nil
+}
+
+// milterTestMessage builds a MIME message, with attachment as file if it is
+// not nil.
+func milterTestMessage(from, rcpt string, attachment []byte) milterMessage {
+	msg := milterMessage{
+		From: from,
+		Rcpt: rcpt,
+		Headers: [][2]string{
+			{"From", "<" + from + ">"},
+			{"To", "<" + rcpt + ">"},
+			{"Subject", "clamav-exporter test message"},
+			{"Date", time.Now().Format(time.RFC1123Z)},
+			{"Message-ID", fmt.Sprintf("<%d.clamav-exporter@localhost>", time.Now().UnixNano())},
+			{"MIME-Version", "1.0"},
+			{"Content-Type", "multipart/mixed; boundary=\"" + milterBoundary + "\""},
+		},
+	}
+
+	var body bytes.Buffer
+	body.WriteString("--" + milterBoundary + "\r\n")
+	body.WriteString("Content-Type: text/plain; charset=us-ascii\r\n\r\n")
+	body.WriteString("This message has been sent to monitor the virus scanner.\r\n")
+	if attachment != nil {
+		body.WriteString("--" + milterBoundary + "\r\n")
+		body.WriteString("Content-Type: application/octet-stream; name=\"eicar.com\"\r\n")
+		body.WriteString("Content-Disposition: attachment; filename=\"eicar.com\"\r\n")
+		body.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+		encoded := base64.StdEncoding.EncodeToString(attachment)
+		for len(encoded) > 76 {
+			body.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		body.WriteString(encoded + "\r\n")
+	}
+	body.WriteString("--" + milterBoundary + "--\r\n")
+	msg.Body = body.Bytes()
+	return msg
+}
+
+func (c *MilterChecker) collect(ch chan<- prometheus.Metric, res milterCheckResult) {
+	version := math.NaN()
+	for _, t := range []milterTransactionResult{res.eicar, res.clean} {
+		if t.negotiated {
+			version = float64(t.version)
+			break
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(
+		c.promMilterUp,
+		prometheus.GaugeValue,
+		boolToFloat(!math.IsNaN(version)),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		c.promMilterProtocolVersion,
+		prometheus.GaugeValue,
+		version,
+	)
+
+	eicarDetected, cleanAccepted := math.NaN(), math.NaN()
+	if probeErr(res.probes, "eicar") == nil {
+		eicarDetected = boolToFloat(res.eicar.result.infected())
+	}
+	if probeErr(res.probes, "clean") == nil {
+		cleanAccepted = boolToFloat(!res.clean.result.infected() &&
+			(res.clean.result.Action == milterActionAccept || res.clean.result.Action == milterActionAddHeader))
+	}
+	ch <- prometheus.MustNewConstMetric(
+		c.promMilterEicarDetected,
+		prometheus.GaugeValue,
+		eicarDetected,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		c.promMilterCleanAccepted,
+		prometheus.GaugeValue,
+		cleanAccepted,
+	)
+
+	for _, p := range []struct {
+		name string
+		t    milterTransactionResult
+	}{{"eicar", res.eicar}, {"clean", res.clean}} {
+		ch <- prometheus.MustNewConstMetric(
+			c.promMilterRoundTrip,
+			prometheus.GaugeValue,
+			p.t.roundTrip,
+			p.name,
+		)
+		if probeErr(res.probes, p.name) != nil {
+			continue
+		}
+		for _, action := range milterActions {
+			ch <- prometheus.MustNewConstMetric(
+				c.promMilterAction,
+				prometheus.GaugeValue,
+				boolToFloat(p.t.result.Action == action),
+				p.name,
+				action,
+			)
+		}
+	}
+
+	for _, p := range res.probes {
+		ch <- prometheus.MustNewConstMetric(
+			c.promMilterProbeTimeout,
+			prometheus.GaugeValue,
+			boolToFloat(isTimeout(p.err)),
+			p.name,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.promMilterProbeDuration,
+			prometheus.GaugeValue,
+			p.duration.Seconds(),
+			p.name,
+		)
+	}
+	c.promMilterProbeLatency.Collect(ch)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.promMilterLastProbeTime,
+		prometheus.GaugeValue,
+		float64(res.time.UnixNano())/1e9,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		c.promMilterProbeAge,
+		prometheus.GaugeValue,
+		time.Since(res.time).Seconds(),
+	)
+}
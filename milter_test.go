@@ -0,0 +1,41 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMilterCheckerGather(t *testing.T) {
+	r := require.New(t)
+	f := newFakeMilter(t, 6, milterNRHeader, false)
+	defer f.Close()
+
+	values := gatherMetrics(t, NewMilterChecker("relay", MilterOptions{URL: f.URL()}), "probe", "action")
+	r.Equal(1.0, values["clamav_milter_up"])
+	r.Equal(6.0, values["clamav_milter_protocol_version"])
+	r.Equal(1.0, values["clamav_milter_eicar_detected"])
+	r.Equal(1.0, values["clamav_milter_clean_accepted"])
+	r.Equal(1.0, values["clamav_milter_action/eicar/reject"])
+	r.Equal(0.0, values["clamav_milter_action/eicar/accept"])
+	r.Equal(1.0, values["clamav_milter_action/clean/accept"])
+	r.True(values["clamav_milter_round_trip_seconds/eicar"] > 0)
+}
+
+func TestMilterCheckerDown(t *testing.T) {
+	r := require.New(t)
+
+	// nothing listens on the port of a closed listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	addr := l.Addr().String()
+	l.Close()
+
+	values := gatherMetrics(t, NewMilterChecker("", MilterOptions{URL: "tcp://" + addr}), "probe", "action")
+	r.Equal(0.0, values["clamav_milter_up"])
+	r.NotContains(values, "clamav_milter_action/eicar/reject")
+}
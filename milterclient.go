@@ -0,0 +1,429 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// milterVersion is the highest protocol version the client speaks, the
+	// one of sendmail 8.14 and postfix
+	milterVersion = 6
+	// milterChunkSize is the maximum size of a body chunk
+	milterChunkSize = 65535
+	// milterMaxPacketSize limits the size of the packets read from the
+	// filter
+	milterMaxPacketSize = 1 << 20
+)
+
+// milter commands sent by the MTA
+const (
+	milterCmdBody    = 'B'
+	milterCmdConnect = 'C'
+	milterCmdEOB     = 'E'
+	milterCmdHelo    = 'H'
+	milterCmdHeader  = 'L'
+	milterCmdMail    = 'M'
+	milterCmdEOH     = 'N'
+	milterCmdOptNeg  = 'O'
+	milterCmdQuit    = 'Q'
+	milterCmdRcpt    = 'R'
+	milterCmdData    = 'T'
+)
+
+// milter replies and modification actions sent by the filter
+const (
+	milterReplyAddRcpt    = '+'
+	milterReplyAddRcptPar = '2'
+	milterReplyDelRcpt    = '-'
+	milterReplyAccept     = 'a'
+	milterReplyReplBody   = 'b'
+	milterReplyContinue   = 'c'
+	milterReplyDiscard    = 'd'
+	milterReplyChgFrom    = 'e'
+	milterReplyAddHeader  = 'h'
+	milterReplyInsHeader  = 'i'
+	milterReplyChgHeader  = 'm'
+	milterReplyOptNeg     = 'O'
+	milterReplyProgress   = 'p'
+	milterReplyQuarantine = 'q'
+	milterReplyReject     = 'r'
+	milterReplySkip       = 's'
+	milterReplyTempFail   = 't'
+	milterReplyReplyCode  = 'y'
+)
+
+// milter protocol flags, a filter uses the NO* flags to skip steps it is not
+// interested in and the NR* flags for steps it does not reply to
+const (
+	milterNoConnect uint32 = 1 << iota
+	milterNoHelo
+	milterNoMail
+	milterNoRcpt
+	milterNoBody
+	milterNoHeaders
+	milterNoEOH
+	milterNRHeader
+	milterNoUnknown
+	milterNoData
+	milterSkip
+	milterRcptRej
+	milterNRConnect
+	milterNRHelo
+	milterNRMail
+	milterNRRcpt
+	milterNRData
+	milterNRUnknown
+	milterNREOH
+	milterNRBody
+	milterHeaderLeadingSpace
+
+	// milterAllActions are all modification actions a filter may request
+	milterAllActions uint32 = 0x1ff
+	// milterOfferedProtocol are the protocol flags the client supports, a
+	// leading space of header values is not preserved
+	milterOfferedProtocol = milterHeaderLeadingSpace - 1
+)
+
+// milter actions reported for a transaction
+const (
+	milterActionAccept     = "accept"
+	milterActionAddHeader  = "add-header"
+	milterActionDiscard    = "discard"
+	milterActionQuarantine = "quarantine"
+	milterActionReject     = "reject"
+	milterActionTempFail   = "tempfail"
+)
+
+var (
+	milterActions = []string{
+		milterActionAccept,
+		milterActionAddHeader,
+		milterActionDiscard,
+		milterActionQuarantine,
+		milterActionReject,
+		milterActionTempFail,
+	}
+	errMilterPacketTooLarge = errors.New("milter packet too large")
+)
+
+// milterMessage is the SMTP transaction sent to the filter.
+type milterMessage struct {
+	From    string
+	Rcpt    string
+	Headers [][2]string
+	Body    []byte
+}
+
+// milterHeader is a header added or changed by the filter.
+type milterHeader struct {
+	Name  string
+	Value string
+}
+
+// milterResult is the outcome of a transaction.
+type milterResult struct {
+	// Action is one of the milterAction* values
+	Action string
+	// ReplyCode is the SMTP reply set by the filter, e.g. "550 5.7.1 ..."
+	ReplyCode string
+	Headers   []milterHeader
+}
+
+// infected reports whether the filter has caught the message, either by
+// rejecting, discarding or quarantining it or by tagging it with the header
+// of clamav-milter, X-Virus-Status: Infected (<signature>).
+func (r milterResult) infected() bool {
+	switch r.Action {
+	case milterActionReject, milterActionDiscard, milterActionQuarantine:
+		return true
+	}
+	for _, h := range r.Headers {
+		if strings.EqualFold(h.Name, "X-Virus-Status") && strings.HasPrefix(strings.TrimSpace(h.Value), "Infected") {
+			return true
+		}
+	}
+	return false
+}
+
+// milterClient speaks the milter protocol as MTA over a single connection.
+// Like clamdClient, it honours the read timeout as well as the deadline of
+// the context it was dialed with.
+type milterClient struct {
+	conn        net.Conn
+	ctx         context.Context
+	readTimeout time.Duration
+
+	// negotiated with the filter
+	version  uint32
+	actions  uint32
+	protocol uint32
+}
+
+// dialMilter connects to a milter, the URL has the same form as the one of
+// clamd, e.g. tcp://127.0.0.1:7357 or unix:///run/clamav-milter/milter.sock.
+func dialMilter(ctx context.Context, rawurl string, t Timeouts) (*milterClient, error) {
+	network, address, err := parseClamDURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{Timeout: t.Connect.Duration}
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &milterClient{
+		conn:        conn,
+		ctx:         ctx,
+		readTimeout: t.Read.Duration,
+	}, nil
+}
+
+func (c *milterClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *milterClient) writePacket(cmd byte, data []byte) error {
+	if err := c.conn.SetWriteDeadline(deadline(c.ctx, c.readTimeout)); err != nil {
+		return err
+	}
+	packet := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(1+len(data)))
+	packet[4] = cmd
+	_, err := c.conn.Write(append(packet, data...))
+	return err
+}
+
+func (c *milterClient) readPacket() (cmd byte, data []byte, err error) {
+	if err = c.conn.SetReadDeadline(deadline(c.ctx, c.readTimeout)); err != nil {
+		return
+	}
+	var size uint32
+	if err = binary.Read(c.conn, binary.BigEndian, &size); err != nil {
+		return
+	}
+	if size == 0 {
+		err = errors.New("empty milter packet")
+		return
+	}
+	if size > milterMaxPacketSize {
+		err = errMilterPacketTooLarge
+		return
+	}
+	packet := make([]byte, size)
+	if _, err = io.ReadFull(c.conn, packet); err != nil {
+		return
+	}
+	return packet[0], packet[1:], nil
+}
+
+// Negotiate offers all actions and protocol steps to the filter and stores
+// the ones it has chosen.
+func (c *milterClient) Negotiate() error {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[0:], milterVersion)
+	binary.BigEndian.PutUint32(data[4:], milterAllActions)
+	binary.BigEndian.PutUint32(data[8:], milterOfferedProtocol)
+	if err := c.writePacket(milterCmdOptNeg, data); err != nil {
+		return err
+	}
+	cmd, data, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if cmd != milterReplyOptNeg || len(data) < 12 {
+		return fmt.Errorf("got invalid milter option negotiation reply %q", cmd)
+	}
+	c.version = binary.BigEndian.Uint32(data[0:])
+	if c.version < 2 {
+		return fmt.Errorf("unsupported milter protocol version %d", c.version)
+	}
+	if c.version > milterVersion {
+		c.version = milterVersion
+	}
+	c.actions = binary.BigEndian.Uint32(data[4:])
+	c.protocol = binary.BigEndian.Uint32(data[8:]) & milterOfferedProtocol
+	return nil
+}
+
+// Version is the negotiated protocol version.
+func (c *milterClient) Version() uint32 {
+	return c.version
+}
+
+// step sends a command unless the filter has opted out of it by the no flag.
+// Unless the filter does not reply to the command because of the nr flag,
+// the reply is returned with done set if it ends the transaction.
+func (c *milterClient) step(cmd byte, data []byte, no, nr uint32, res *milterResult) (done bool, err error) {
+	if c.protocol&no != 0 {
+		return false, nil
+	}
+	if err = c.writePacket(cmd, data); err != nil {
+		return
+	}
+	if nr != 0 && c.protocol&nr != 0 {
+		return false, nil
+	}
+	for {
+		var reply byte
+		if reply, data, err = c.readPacket(); err != nil {
+			return
+		}
+		switch reply {
+		case milterReplyProgress:
+			continue
+		case milterReplyContinue, milterReplySkip:
+			return false, nil
+		}
+		if cmd == milterCmdEOB {
+			if handled, err := c.modification(reply, data, res); handled || err != nil {
+				if err != nil {
+					return true, err
+				}
+				continue
+			}
+		}
+		return true, c.final(cmd, reply, data, res)
+	}
+}
+
+// modification records the changes a filter requests at the end of the
+// body. It returns false for replies which are not a modification.
+func (c *milterClient) modification(reply byte, data []byte, res *milterResult) (bool, error) {
+	switch reply {
+	case milterReplyAddHeader:
+		name, value := milterStrings2(data)
+		res.Headers = append(res.Headers, milterHeader{name, value})
+	case milterReplyInsHeader, milterReplyChgHeader:
+		if len(data) < 4 {
+			return true, fmt.Errorf("got invalid milter reply %q", reply)
+		}
+		name, value := milterStrings2(data[4:])
+		res.Headers = append(res.Headers, milterHeader{name, value})
+	case milterReplyQuarantine:
+		res.Action = milterActionQuarantine
+	case milterReplyAddRcpt, milterReplyDelRcpt, milterReplyReplBody, milterReplyChgFrom, milterReplyAddRcptPar:
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// final records the reply which ends the transaction.
+func (c *milterClient) final(cmd, reply byte, data []byte, res *milterResult) error {
+	switch reply {
+	case milterReplyAccept:
+		if res.Action == "" {
+			res.Action = milterActionAccept
+		}
+	case milterReplyReject:
+		res.Action = milterActionReject
+	case milterReplyDiscard:
+		res.Action = milterActionDiscard
+	case milterReplyTempFail:
+		res.Action = milterActionTempFail
+	case milterReplyReplyCode:
+		res.ReplyCode = strings.TrimRight(string(data), "\x00")
+		if strings.HasPrefix(res.ReplyCode, "4") {
+			res.Action = milterActionTempFail
+		} else {
+			res.Action = milterActionReject
+		}
+	default:
+		return fmt.Errorf("got invalid milter reply %q to %q", reply, cmd)
+	}
+	return nil
+}
+
+func milterStrings2(data []byte) (a, b string) {
+	f := bytes.SplitN(data, []byte{0}, 3)
+	a = string(f[0])
+	if len(f) > 1 {
+		b = string(f[1])
+	}
+	return
+}
+
+func milterString(s ...string) []byte {
+	var b []byte
+	for _, s := range s {
+		b = append(b, s...)
+		b = append(b, 0)
+	}
+	return b
+}
+
+// milterStep is a command of the SMTP transaction along with the protocol
+// flags to skip it and to not wait for its reply.
+type milterStep struct {
+	cmd    byte
+	data   []byte
+	no, nr uint32
+}
+
+// Transaction sends msg as a single SMTP transaction from localhost and
+// returns what the filter decided. The client must have been negotiated.
+func (c *milterClient) Transaction(msg milterMessage) (res milterResult, err error) {
+	// an SMTP client at 127.0.0.1 port 25
+	connect := append(milterString("localhost"), '4', 0, 25)
+	connect = append(connect, milterString("127.0.0.1")...)
+
+	steps := []milterStep{
+		{milterCmdConnect, connect, milterNoConnect, milterNRConnect},
+		{milterCmdHelo, milterString("localhost"), milterNoHelo, milterNRHelo},
+		{milterCmdMail, milterString("<" + msg.From + ">"), milterNoMail, milterNRMail},
+		{milterCmdRcpt, milterString("<" + msg.Rcpt + ">"), milterNoRcpt, milterNRRcpt},
+	}
+	if c.version >= 6 {
+		steps = append(steps, milterStep{milterCmdData, nil, milterNoData, milterNRData})
+	}
+	for _, s := range steps {
+		if done, err := c.step(s.cmd, s.data, s.no, s.nr, &res); done || err != nil {
+			return res, err
+		}
+	}
+	for _, h := range msg.Headers {
+		if done, err := c.step(milterCmdHeader, milterString(h[0], h[1]), milterNoHeaders, milterNRHeader, &res); done || err != nil {
+			return res, err
+		}
+	}
+	if done, err := c.step(milterCmdEOH, nil, milterNoEOH, milterNREOH, &res); done || err != nil {
+		return res, err
+	}
+	body := msg.Body
+	for len(body) > 0 {
+		n := len(body)
+		if n > milterChunkSize {
+			n = milterChunkSize
+		}
+		if done, err := c.step(milterCmdBody, body[:n], milterNoBody, milterNRBody, &res); done || err != nil {
+			return res, err
+		}
+		body = body[n:]
+	}
+	if _, err = c.step(milterCmdEOB, nil, 0, 0, &res); err != nil {
+		return
+	}
+	if res.Action == "" {
+		res.Action = milterActionAccept
+	}
+	if res.Action == milterActionAccept && len(res.Headers) > 0 {
+		res.Action = milterActionAddHeader
+	}
+	return
+}
+
+// Quit ends the session, the filter does not reply.
+func (c *milterClient) Quit() error {
+	return c.writePacket(milterCmdQuit, nil)
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMilter implements the filter side of the milter protocol like
+// clamav-milter, either rejecting infected messages or tagging all messages
+// with an X-Virus-Status header.
+type fakeMilter struct {
+	l        net.Listener
+	version  uint32
+	protocol uint32
+	tag      bool
+
+	mu   sync.Mutex
+	cmds []byte
+	// clean is the X-Virus-Status of clean messages
+	clean string
+}
+
+func newFakeMilter(t *testing.T, version, protocol uint32, tag bool) *fakeMilter {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeMilter{l: l, version: version, protocol: protocol, tag: tag, clean: "Clean"}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeMilter) Close() error {
+	return f.l.Close()
+}
+
+func (f *fakeMilter) URL() string {
+	return "tcp://" + f.l.Addr().String()
+}
+
+// commands returns the commands received so far.
+func (f *fakeMilter) commands() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return string(f.cmds)
+}
+
+func writeMilterPacket(w io.Writer, cmd byte, data []byte) error {
+	packet := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(1+len(data)))
+	packet[4] = cmd
+	_, err := w.Write(append(packet, data...))
+	return err
+}
+
+func (f *fakeMilter) serve(conn net.Conn) {
+	defer conn.Close()
+
+	noReply := map[byte]uint32{
+		milterCmdConnect: milterNRConnect,
+		milterCmdHelo:    milterNRHelo,
+		milterCmdMail:    milterNRMail,
+		milterCmdRcpt:    milterNRRcpt,
+		milterCmdData:    milterNRData,
+		milterCmdHeader:  milterNRHeader,
+		milterCmdEOH:     milterNREOH,
+		milterCmdBody:    milterNRBody,
+	}
+	var body []byte
+	for {
+		var size uint32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		packet := make([]byte, size)
+		if _, err := io.ReadFull(conn, packet); err != nil {
+			return
+		}
+		cmd, data := packet[0], packet[1:]
+		f.mu.Lock()
+		f.cmds = append(f.cmds, cmd)
+		f.mu.Unlock()
+
+		var err error
+		switch cmd {
+		case milterCmdOptNeg:
+			reply := make([]byte, 12)
+			binary.BigEndian.PutUint32(reply[0:], f.version)
+			binary.BigEndian.PutUint32(reply[4:], 0x1)
+			binary.BigEndian.PutUint32(reply[8:], f.protocol)
+			err = writeMilterPacket(conn, milterReplyOptNeg, reply)
+		case milterCmdQuit:
+			return
+		case milterCmdEOB:
+			err = f.endOfBody(conn, body)
+			body = nil
+		default:
+			if cmd == milterCmdBody {
+				body = append(body, data...)
+			}
+			if f.protocol&noReply[cmd] == 0 {
+				err = writeMilterPacket(conn, milterReplyContinue, nil)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeMilter) endOfBody(w io.Writer, body []byte) error {
+	if err := writeMilterPacket(w, milterReplyProgress, nil); err != nil {
+		return err
+	}
+	body = bytes.Replace(body, []byte("\r\n"), nil, -1)
+	infected := bytes.Contains(body, []byte(base64.StdEncoding.EncodeToString(eicar)))
+	if !f.tag {
+		if infected {
+			return writeMilterPacket(w, milterReplyReplyCode, milterString("550 5.7.1 Eicar-Test-Signature FOUND"))
+		}
+		return writeMilterPacket(w, milterReplyAccept, nil)
+	}
+	f.mu.Lock()
+	status := f.clean
+	f.mu.Unlock()
+	if infected {
+		status = "Infected (Eicar-Test-Signature)"
+	}
+	if err := writeMilterPacket(w, milterReplyAddHeader, milterString("X-Virus-Status", status)); err != nil {
+		return err
+	}
+	return writeMilterPacket(w, milterReplyContinue, nil)
+}
+
+func milterTransaction(t *testing.T, f *fakeMilter, attachment []byte) (*milterClient, milterResult) {
+	r := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cl, err := dialMilter(ctx, f.URL(), Timeouts{}.withDefaults())
+	r.NoError(err)
+	defer cl.Close()
+	r.NoError(cl.Negotiate())
+	res, err := cl.Transaction(milterTestMessage("sender@example.com", "rcpt@example.com", attachment))
+	r.NoError(err)
+	r.NoError(cl.Quit())
+	return cl, res
+}
+
+func TestMilterClientReject(t *testing.T) {
+	r := require.New(t)
+	f := newFakeMilter(t, 6, 0, false)
+	defer f.Close()
+
+	cl, res := milterTransaction(t, f, eicar)
+	r.Equal(uint32(6), cl.Version())
+	r.Equal(milterActionReject, res.Action)
+	r.Equal("550 5.7.1 Eicar-Test-Signature FOUND", res.ReplyCode)
+	r.True(res.infected())
+
+	_, res = milterTransaction(t, f, nil)
+	r.Equal(milterActionAccept, res.Action)
+	r.False(res.infected())
+}
+
+func TestMilterClientAddHeader(t *testing.T) {
+	r := require.New(t)
+	// like clamav-milter, which neither needs the connect and helo steps
+	// nor replies to headers
+	f := newFakeMilter(t, 6, milterNoConnect|milterNoHelo|milterNRHeader|milterNRBody, true)
+	defer f.Close()
+
+	_, res := milterTransaction(t, f, eicar)
+	r.Equal(milterActionAddHeader, res.Action)
+	r.Equal([]milterHeader{{"X-Virus-Status", "Infected (Eicar-Test-Signature)"}}, res.Headers)
+	r.True(res.infected())
+	r.NotContains(f.commands(), string(milterCmdConnect))
+	r.NotContains(f.commands(), string(milterCmdHelo))
+
+	_, res = milterTransaction(t, f, nil)
+	r.Equal(milterActionAddHeader, res.Action)
+	r.False(res.infected())
+
+	// only the status of clamav-milter counts, not any mention of infected
+	f.mu.Lock()
+	f.clean = "Not infected"
+	f.mu.Unlock()
+	_, res = milterTransaction(t, f, nil)
+	r.Equal([]milterHeader{{"X-Virus-Status", "Not infected"}}, res.Headers)
+	r.False(res.infected())
+	r.False(milterResult{Action: milterActionAddHeader, Headers: []milterHeader{{"X-Spam-Report", "Infected"}}}.infected())
+	r.True(milterResult{Action: milterActionAddHeader, Headers: []milterHeader{{"x-virus-status", "Infected (Eicar-Test-Signature)"}}}.infected())
+}
+
+func TestMilterClientOldVersion(t *testing.T) {
+	r := require.New(t)
+	f := newFakeMilter(t, 2, 0, false)
+	defer f.Close()
+
+	cl, res := milterTransaction(t, f, eicar)
+	r.Equal(uint32(2), cl.Version())
+	r.Equal(milterActionReject, res.Action)
+	// DATA has been introduced with version 6
+	r.NotContains(f.commands(), string(milterCmdData))
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Module is a named set of checker options that can be used with the /probe
+// endpoint. The target of a probe request overrides the address configured
+// in the module.
+type Module struct {
+	Prober string        `json:"prober"`
+	ClamD  ClamDOptions  `json:"clamd"`
+	Icap   IcapOptions   `json:"icap"`
+	Milter MilterOptions `json:"milter"`
+}
+
+func (m Module) validate() error {
+	switch m.Prober {
+	case "clamd":
+		return m.ClamD.validate()
+	case "milter":
+		return m.Milter.validate()
+	case "icap":
+		return m.Icap.validate()
+	case "":
+		return fmt.Errorf("missing prober")
+	default:
+		return fmt.Errorf("unknown prober %q", m.Prober)
+	}
+}
+
+func newProbeCollector(m Module, target string) (contextChecker, error) {
+	switch m.Prober {
+	case "clamd":
+		opts := m.ClamD
+		opts.URL = target
+		return NewClamDChecker("", opts), nil
+	case "icap":
+		opts := m.Icap
+		host, port, err := net.SplitHostPort(target)
+		if err != nil {
+			// no port given, use the one from the module or the default
+			host = target
+		} else {
+			opts.Port = port
+		}
+		opts.Host = host
+		return NewIcapChecker("", opts), nil
+	case "milter":
+		opts := m.Milter
+		opts.URL = target
+		return NewMilterChecker("", opts), nil
+	default:
+		return nil, fmt.Errorf("unknown prober %q", m.Prober)
+	}
+}
+
+// probeHandler serves the metrics of a single checker which is created for
+// every request, in the style of the blackbox_exporter:
+//
+//	/probe?module=clamd&target=tcp://host:3310
+func probeHandler(modules map[string]Module) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+
+		moduleName := params.Get("module")
+		m, ok := modules[moduleName]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown module %q", moduleName), http.StatusBadRequest)
+			return
+		}
+		target := params.Get("target")
+		if target == "" {
+			http.Error(w, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+
+		c, err := newProbeCollector(m, target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		serveCheckers(w, r, []contextChecker{c})
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewProbeCollector(t *testing.T) {
+	r := require.New(t)
+
+	c, err := newProbeCollector(Module{Prober: "clamd"}, "tcp://scanner1:3310")
+	r.NoError(err)
+	r.Equal("tcp://scanner1:3310", c.(*ClamDChecker).opts.URL)
+
+	c, err = newProbeCollector(Module{Prober: "icap"}, "scanner2:11344")
+	r.NoError(err)
+	r.Equal("scanner2", c.(*IcapChecker).opts.Host)
+	r.Equal("11344", c.(*IcapChecker).opts.Port)
+
+	c, err = newProbeCollector(Module{Prober: "icap", Icap: IcapOptions{Port: "1345"}}, "scanner3")
+	r.NoError(err)
+	r.Equal("scanner3", c.(*IcapChecker).opts.Host)
+	r.Equal("1345", c.(*IcapChecker).opts.Port)
+
+	_, err = newProbeCollector(Module{Prober: "ftp"}, "scanner4")
+	r.Error(err)
+}
+
+func TestProbeHandlerErrors(t *testing.T) {
+	r := require.New(t)
+	h := probeHandler(map[string]Module{"clamd": {Prober: "clamd"}})
+
+	for _, url := range []string{
+		"/probe?module=unknown&target=tcp://localhost:3310",
+		"/probe?module=clamd",
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		r.Equal(http.StatusBadRequest, rec.Code, url)
+	}
+}
+
+func TestProbeHandlerClamD(t *testing.T) {
+	r := require.New(t)
+	f := newFakeClamD(t)
+	defer f.Close()
+
+	h := probeHandler(map[string]Module{"clamd": {Prober: "clamd"}})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probe?module=clamd&target="+url.QueryEscape(f.URL()), nil))
+	r.Equal(http.StatusOK, rec.Code)
+
+	body := rec.Body.String()
+	r.Regexp(`(?m)^clamav_clamd_up\{version="0.102.1"\} 1$`, body)
+	r.Regexp(`(?m)^clamav_clamd_eicar_detected 1$`, body)
+	r.NotContains(body, "instance_name")
+}
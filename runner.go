@@ -0,0 +1,197 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ProbeOptions are shared by the checkers which probe a service, they are
+// embedded in their options.
+type ProbeOptions struct {
+	Timeouts Timeouts `json:"timeouts"`
+	// Parallelism limits the number of probes running at the same time, all
+	// of them run at once if it is <= 0
+	Parallelism int               `json:"parallelism"`
+	Background  BackgroundOptions `json:"background"`
+	// LatencyBuckets are the upper bounds of the buckets of the probe
+	// latency histogram, the defaults of the client library if empty
+	LatencyBuckets []float64 `json:"latency_buckets"`
+}
+
+func (o ProbeOptions) validate() error {
+	return validateBuckets(o.LatencyBuckets)
+}
+
+// BackgroundOptions configure probing in the background. If an interval is
+// set, a checker runs its probes on its own and scrapes are answered with the
+// last result instead of probing on every scrape.
+type BackgroundOptions struct {
+	Interval Duration `json:"interval"`
+	Jitter   Duration `json:"jitter"`
+}
+
+func (o BackgroundOptions) enabled() bool {
+	return o.Interval.Duration > 0
+}
+
+// runBackground calls fn right away and then again after every interval plus
+// a random jitter, until ctx is done.
+func runBackground(ctx context.Context, opts BackgroundOptions, fn func(ctx context.Context)) {
+	for {
+		fn(ctx)
+
+		wait := opts.Interval.Duration
+		if opts.Jitter.Duration > 0 {
+			wait += time.Duration(rand.Int63n(int64(opts.Jitter.Duration)))
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// probe is a single named check of a checker. The probes of a checker are
+// independent of each other and may run concurrently.
+type probe struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// probeStatus is the outcome of running a probe.
+type probeStatus struct {
+	name     string
+	duration time.Duration
+	err      error
+}
+
+// runProbes runs the probes with at most parallel of them at the same time,
+// a parallel value <= 0 runs all of them at once. The status of the probes is
+// returned in the order of the probes.
+func runProbes(ctx context.Context, parallel int, probes []probe) []probeStatus {
+	if parallel <= 0 || parallel > len(probes) {
+		parallel = len(probes)
+	}
+	status := make([]probeStatus, len(probes))
+	sem := make(chan struct{}, parallel)
+
+	var wg sync.WaitGroup
+	for i, p := range probes {
+		wg.Add(1)
+		go func(i int, p probe) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			start := time.Now()
+			err := p.run(ctx)
+			status[i] = probeStatus{
+				name:     p.name,
+				duration: time.Since(start),
+				err:      err,
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	return status
+}
+
+// probeErr returns the error of the named probe.
+func probeErr(status []probeStatus, name string) error {
+	for _, s := range status {
+		if s.name == name {
+			return s.err
+		}
+	}
+	return nil
+}
+
+// logProbeErrors logs the failed probes of a checker. Errors of the same
+// class are logged only once per repeat interval of the logger for a probe.
+func logProbeErrors(checker, name, target string, status []probeStatus) {
+	for _, s := range status {
+		if s.err == nil {
+			continue
+		}
+		key := strings.Join([]string{checker, name, target, s.name, errorClass(s.err)}, "\x00")
+		logger.Limited(levelError, key, "probe failed",
+			"checker", checker,
+			"instance", name,
+			"target", target,
+			"probe", s.name,
+			"duration", s.duration,
+			"err", s.err)
+	}
+}
+
+// errorClass returns a description of err which stays the same for repeated
+// failures of a probe. The messages of network errors contain the local port
+// of the connection, which changes on every attempt, so timeouts and refused
+// connections are reduced to their class and other errors to the innermost
+// wrapped error, like a syscall error or a protocol error of a checker.
+func errorClass(err error) string {
+	switch {
+	case isTimeout(err):
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	}
+	for {
+		u := errors.Unwrap(err)
+		if u == nil {
+			return err.Error()
+		}
+		err = u
+	}
+}
+
+// validateBuckets checks that the configured histogram buckets are strictly
+// increasing, the client library panics otherwise.
+func validateBuckets(buckets []float64) error {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return fmt.Errorf("latency buckets must be strictly increasing, got %v after %v", buckets[i], buckets[i-1])
+		}
+	}
+	return nil
+}
+
+// newProbeLatency creates the histogram of the probe durations of a checker,
+// with the default buckets of the client library if none are configured.
+func newProbeLatency(checker string, buckets []float64, constLabels prometheus.Labels) *prometheus.HistogramVec {
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        "clamav_" + checker + "_probe_latency_seconds",
+		Help:        "histogram of the duration of successful and timed out probes",
+		Buckets:     buckets,
+		ConstLabels: constLabels,
+	}, []string{"probe"})
+}
+
+// observeProbes records the duration of every probe which succeeded or timed
+// out. Other failures, like a refused connection, tell nothing about the
+// latency of the scanner and are left out.
+func observeProbes(h *prometheus.HistogramVec, status []probeStatus) {
+	for _, s := range status {
+		if s.err != nil && !isTimeout(s.err) {
+			continue
+		}
+		h.WithLabelValues(s.name).Observe(s.duration.Seconds())
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+// gatherMetrics registers c in a new registry and returns the values of its
+// metrics, keyed by the metric name followed by "/" and the values of the
+// given labels in their order. Histograms are represented by their count.
+func gatherMetrics(t *testing.T, c prometheus.Collector, labels ...string) map[string]float64 {
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, registry.Register(c))
+	mfs, err := registry.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			labelValues := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labelValues[l.GetName()] = l.GetValue()
+			}
+			name := mf.GetName()
+			for _, l := range labels {
+				if v, ok := labelValues[l]; ok {
+					name += "/" + v
+				}
+			}
+			switch {
+			case m.GetCounter() != nil:
+				values[name] = m.GetCounter().GetValue()
+			case m.GetHistogram() != nil:
+				values[name] = float64(m.GetHistogram().GetSampleCount())
+			default:
+				values[name] = m.GetGauge().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func TestRunProbesParallelism(t *testing.T) {
+	r := require.New(t)
+
+	var (
+		mu      sync.Mutex
+		running int
+		maxSeen int
+	)
+	slow := func(ctx context.Context) error {
+		mu.Lock()
+		running++
+		if running > maxSeen {
+			maxSeen = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}
+	failed := errors.New("failed")
+
+	status := runProbes(context.Background(), 2, []probe{
+		{"a", slow},
+		{"b", slow},
+		{"c", slow},
+		{"d", func(ctx context.Context) error { return failed }},
+	})
+	r.Len(status, 4)
+	r.Equal(2, maxSeen)
+	r.Equal("a", status[0].name)
+	r.NoError(status[0].err)
+	r.True(status[0].duration >= 20*time.Millisecond)
+	r.Equal("d", status[3].name)
+	r.Equal(failed, status[3].err)
+}
+
+func TestRunBackground(t *testing.T) {
+	r := require.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := 0
+	done := make(chan struct{})
+	go func() {
+		runBackground(ctx, BackgroundOptions{
+			Interval: Duration{time.Millisecond},
+			Jitter:   Duration{time.Millisecond},
+		}, func(context.Context) {
+			calls++
+			if calls == 3 {
+				cancel()
+			}
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		r.FailNow("runBackground did not return after cancel")
+	}
+	r.Equal(3, calls)
+}
+
+func TestObserveProbes(t *testing.T) {
+	r := require.New(t)
+
+	r.NoError(validateBuckets(nil))
+	r.NoError(validateBuckets([]float64{0.1, 0.5, 1}))
+	r.Error(validateBuckets([]float64{0.1, 0.1}))
+	r.Error(validateBuckets([]float64{1, 0.5}))
+
+	h := newProbeLatency("test", []float64{0.1, 1}, nil)
+	for i := 0; i < 3; i++ {
+		observeProbes(h, []probeStatus{
+			{name: "ok", duration: 50 * time.Millisecond},
+			{name: "timeout", duration: 2 * time.Second, err: context.DeadlineExceeded},
+			{name: "refused", duration: time.Millisecond, err: errors.New("connection refused")},
+		})
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	r.NoError(registry.Register(h))
+	mfs, err := registry.Gather()
+	r.NoError(err)
+	r.Len(mfs, 1)
+	r.Equal("clamav_test_probe_latency_seconds", mfs[0].GetName())
+
+	counts := make(map[string]uint64)
+	for _, m := range mfs[0].GetMetric() {
+		hist := m.GetHistogram()
+		r.Len(hist.GetBucket(), 2)
+		counts[m.GetLabel()[0].GetValue()] = hist.GetSampleCount()
+		if m.GetLabel()[0].GetValue() == "ok" {
+			r.Equal(uint64(3), hist.GetBucket()[0].GetCumulativeCount())
+		}
+	}
+	r.Equal(map[string]uint64{"ok": 3, "timeout": 3}, counts)
+}
+
+func TestLogProbeErrors(t *testing.T) {
+	r := require.New(t)
+	l, buf, _ := newTestLogger(t, LogOptions{})
+	defer func(orig *structuredLogger) { logger = orig }(logger)
+	logger = l
+
+	netErr := func(port int, errno syscall.Errno) error {
+		return &net.OpError{
+			Op:     "read",
+			Net:    "tcp",
+			Source: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port},
+			Addr:   &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1344},
+			Err:    os.NewSyscallError("read", errno),
+		}
+	}
+	for port := 40000; port < 40003; port++ {
+		logProbeErrors("icap", "", "127.0.0.1:1344", []probeStatus{
+			{name: "eicar", err: netErr(port, syscall.ECONNRESET)},
+			{name: "clean", err: fmt.Errorf("icap request: %w", context.DeadlineExceeded)},
+			{name: "options", err: netErr(port, syscall.ECONNREFUSED)},
+			{name: "version"},
+		})
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	r.Len(lines, 3)
+	r.Contains(lines[0], "127.0.0.1:40000->127.0.0.1:1344")
+
+	r.Equal("timeout", errorClass(fmt.Errorf("icap request: %w", context.DeadlineExceeded)))
+	r.Equal("refused", errorClass(netErr(40000, syscall.ECONNREFUSED)))
+	r.Equal(errClamDUnknownCommand.Error(), errorClass(fmt.Errorf("clamd STATS: %w", errClamDUnknownCommand)))
+	r.Equal(syscall.ECONNRESET.Error(), errorClass(netErr(40001, syscall.ECONNRESET)))
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	defaultConnectTimeout = 2 * time.Second
+	defaultReadTimeout    = 5 * time.Second
+	defaultOverallTimeout = 10 * time.Second
+
+	// scrapeTimeoutOffset is subtracted from the scrape timeout sent by
+	// Prometheus to leave some time for sending the metrics.
+	scrapeTimeoutOffset = 500 * time.Millisecond
+
+	// writeTimeoutMargin is added to the largest overall timeout to get the
+	// write timeout of the HTTP server, see Config.writeTimeout.
+	writeTimeoutMargin = 5 * time.Second
+)
+
+// Duration is a time.Duration which is read from a string like "1m30s" in the
+// configuration file.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Timeouts limit the time spent in the probes of a checker. Connect and Read
+// apply to every single connection attempt and response, Overall limits all
+// probes of a scrape together.
+type Timeouts struct {
+	Connect Duration `json:"connect"`
+	Read    Duration `json:"read"`
+	Overall Duration `json:"overall"`
+}
+
+func (t Timeouts) withDefaults() Timeouts {
+	if t.Connect.Duration <= 0 {
+		t.Connect.Duration = defaultConnectTimeout
+	}
+	if t.Read.Duration <= 0 {
+		t.Read.Duration = defaultReadTimeout
+	}
+	if t.Overall.Duration <= 0 {
+		t.Overall.Duration = defaultOverallTimeout
+	}
+	return t
+}
+
+// deadline returns the point in time after which an I/O operation which is
+// started now must be aborted.
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	d := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(d) {
+		return ctxDeadline
+	}
+	return d
+}
+
+// isTimeout reports whether err was caused by an exceeded deadline.
+func isTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// scrapeTimeout returns the timeout Prometheus sends along with each scrape
+// request, minus some time which is needed to encode the metrics.
+func scrapeTimeout(r *http.Request) (time.Duration, error) {
+	v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if v == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse scrape timeout %q: %v", v, err)
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > 2*scrapeTimeoutOffset {
+		timeout -= scrapeTimeoutOffset
+	}
+	return timeout, nil
+}
+
+// contextChecker is implemented by all checkers. CollectContext aborts all
+// probes as soon as the context is done.
+type contextChecker interface {
+	prometheus.Collector
+	CollectContext(ctx context.Context, ch chan<- prometheus.Metric)
+}
+
+// boundChecker binds a checker to the context of a single scrape.
+type boundChecker struct {
+	contextChecker
+	ctx context.Context
+}
+
+func (b boundChecker) Collect(ch chan<- prometheus.Metric) {
+	b.CollectContext(b.ctx, ch)
+}
+
+// serveCheckers registers the checkers in a new registry which is bound to
+// the scrape timeout of the request and serves their metrics.
+func serveCheckers(w http.ResponseWriter, r *http.Request, checkers []contextChecker) {
+	ctx := r.Context()
+	timeout, err := scrapeTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	for _, c := range checkers {
+		if err := registry.Register(boundChecker{c, ctx}); err != nil {
+			http.Error(w, fmt.Sprintf("failed to register checker: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// metricsHandler serves the metrics of the checkers configured in the
+// configuration file.
+func metricsHandler(checkers []contextChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveCheckers(w, r, checkers)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrapeTimeout(t *testing.T) {
+	r := require.New(t)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	timeout, err := scrapeTimeout(req)
+	r.NoError(err)
+	r.Zero(timeout)
+
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+	timeout, err = scrapeTimeout(req)
+	r.NoError(err)
+	r.Equal(9500*time.Millisecond, timeout)
+
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.5")
+	timeout, err = scrapeTimeout(req)
+	r.NoError(err)
+	r.Equal(500*time.Millisecond, timeout)
+
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "soon")
+	_, err = scrapeTimeout(req)
+	r.Error(err)
+}
+
+// newSilentListener returns a listener which accepts connections but never
+// answers. The connections are closed along with the listener.
+func newSilentListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				for _, conn := range conns {
+					conn.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return l
+}
+
+func TestIcapReadTimeout(t *testing.T) {
+	r := require.New(t)
+
+	l := newSilentListener(t)
+	defer l.Close()
+
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	r.NoError(err)
+	c := NewIcapChecker("", IcapOptions{
+		Host: host,
+		Port: port,
+		ProbeOptions: ProbeOptions{
+			Timeouts: Timeouts{
+				Read: Duration{100 * time.Millisecond},
+			},
+		},
+	})
+
+	start := time.Now()
+	_, _, err = c.testIcap(context.Background(), c.newSession(), []byte("hello"))
+	r.True(isTimeout(err), "%v", err)
+	r.True(time.Since(start) < time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c.opts.Timeouts.Read.Duration = time.Minute
+	_, _, err = c.testIcap(ctx, c.newSession(), []byte("hello"))
+	r.True(isTimeout(err), "%v", err)
+}
+
+func TestConfigWriteTimeout(t *testing.T) {
+	r := require.New(t)
+
+	var cfg Config
+	r.Equal(defaultOverallTimeout+writeTimeoutMargin, cfg.writeTimeout())
+
+	r.NoError(json.Unmarshal([]byte(`{
+		"clamd": [{"timeouts": {"overall": "20s"}}],
+		"icap": [{"timeouts": {"overall": "30s"}}]
+	}`), &cfg))
+	r.Equal(30*time.Second+writeTimeoutMargin, cfg.writeTimeout())
+
+	r.NoError(json.Unmarshal([]byte(`{
+		"modules": {"icap": {"prober": "icap", "icap": {"timeouts": {"overall": "1m"}}}}
+	}`), &cfg))
+	r.Equal(time.Minute+writeTimeoutMargin, cfg.writeTimeout())
+}
+
+// TestScrapeOverallTimeout checks that a scrape which runs into the overall
+// timeout still delivers its metrics, the write timeout of the HTTP server
+// must not expire before.
+func TestScrapeOverallTimeout(t *testing.T) {
+	r := require.New(t)
+
+	l := newSilentListener(t)
+	defer l.Close()
+
+	var cfg Config
+	r.NoError(json.Unmarshal([]byte(`{
+		"icap": [{
+			"host": "127.0.0.1",
+			"port": "`+strconv.Itoa(l.Addr().(*net.TCPAddr).Port)+`",
+			"keep_alive": true,
+			"parallelism": 1,
+			"timeouts": {"read": "10s", "overall": "1s"}
+		}]
+	}`), &cfg))
+	c := NewIcapChecker("", cfg.Icap[0].IcapOptions)
+
+	srvListener, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	srv := &http.Server{
+		Handler:      metricsHandler([]contextChecker{c}),
+		WriteTimeout: cfg.writeTimeout(),
+	}
+	go srv.Serve(srvListener)
+	defer srv.Close()
+
+	resp, err := http.Get("http://" + srvListener.Addr().String() + "/metrics")
+	r.NoError(err)
+	defer resp.Body.Close()
+	r.Equal(http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	r.NoError(err)
+	r.Contains(string(body), `clamav_icap_probe_timeout{probe="eicar"} 1`)
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TLSOptions enables TLS for the connections to a scanner, e.g. c-icap
+// listening for ICAPS or clamd behind stunnel.
+type TLSOptions struct {
+	// CAFile is a PEM bundle of the CAs which are trusted instead of the
+	// ones of the system
+	CAFile string `json:"ca_file"`
+	// CertFile and KeyFile are the client certificate and its key
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ServerName is verified instead of the host of the target
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+func (o TLSOptions) validate() error {
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return errors.New("tls cert_file and key_file must be set together")
+	}
+	return nil
+}
+
+// config builds the client configuration for a connection to address. The
+// files are read for every connection, so that renewed certificates are
+// picked up without a restart.
+func (o TLSOptions) config(address string) (*tls.Config, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		cfg.ServerName = host
+	}
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CAFile)
+		}
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// tlsState describes an established TLS connection.
+type tlsState struct {
+	handshake time.Duration
+	// certExpiry is the end of the validity of the peer certificate
+	certExpiry time.Time
+}
+
+// dialTLS connects to address within the connect timeout and, unless opts is
+// nil, performs a TLS handshake within the same timeout. The returned state is
+// nil for plain connections.
+func dialTLS(ctx context.Context, network, address string, t Timeouts, opts *TLSOptions) (net.Conn, *tlsState, error) {
+	d := net.Dialer{Timeout: t.Connect.Duration}
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil || opts == nil {
+		return conn, nil, err
+	}
+
+	cfg, err := opts.config(address)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.SetDeadline(deadline(ctx, t.Connect.Duration)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	start := time.Now()
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("tls handshake with %s failed: %w", address, err)
+	}
+	state := &tlsState{handshake: time.Since(start)}
+	if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		state.certExpiry = certs[0].NotAfter
+	}
+	if err := tlsConn.SetDeadline(time.Time{}); err != nil {
+		tlsConn.Close()
+		return nil, nil, err
+	}
+	return tlsConn, state, nil
+}
+
+// collectTLS exports the handshake duration and the certificate expiry of a
+// TLS connection, nothing for a plain one.
+func collectTLS(ch chan<- prometheus.Metric, handshake, certExpiry *prometheus.Desc, state *tlsState) {
+	if state == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(
+		handshake,
+		prometheus.GaugeValue,
+		state.handshake.Seconds(),
+	)
+	if !state.certExpiry.IsZero() {
+		ch <- prometheus.MustNewConstMetric(
+			certExpiry,
+			prometheus.GaugeValue,
+			float64(state.certExpiry.Unix()),
+		)
+	}
+}
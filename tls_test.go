@@ -0,0 +1,159 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificate writes a self-signed certificate for localhost, valid until
+// notAfter, and its key to dir.
+func testCertificate(t *testing.T, dir string, notAfter time.Time) (certFile, keyFile string) {
+	r := require.New(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	r.NoError(err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	r.NoError(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	r.NoError(err)
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	r.NoError(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	r.NoError(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return
+}
+
+// listenTLS returns a TLS listener on localhost which requires a client
+// certificate signed by the same certificate.
+func listenTLS(t *testing.T, certFile, keyFile string) net.Listener {
+	r := require.New(t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	r.NoError(err)
+	pool := x509.NewCertPool()
+	pemData, err := ioutil.ReadFile(certFile)
+	r.NoError(err)
+	r.True(pool.AppendCertsFromPEM(pemData))
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	r.NoError(err)
+	return l
+}
+
+func TestTLSOptions(t *testing.T) {
+	r := require.New(t)
+	r.Error(TLSOptions{CertFile: "cert.pem"}.validate())
+	r.NoError(TLSOptions{CertFile: "cert.pem", KeyFile: "key.pem"}.validate())
+
+	cfg, err := TLSOptions{}.config("scanner.example.com:11344")
+	r.NoError(err)
+	r.Equal("scanner.example.com", cfg.ServerName)
+	cfg, err = TLSOptions{ServerName: "icap.example.com"}.config("10.0.0.1:11344")
+	r.NoError(err)
+	r.Equal("icap.example.com", cfg.ServerName)
+
+	_, err = TLSOptions{CAFile: "/nonexistent/ca.pem"}.config("localhost:11344")
+	r.Error(err)
+}
+
+func TestClamDCheckerTLS(t *testing.T) {
+	r := require.New(t)
+	dir, err := ioutil.TempDir("", "clamav-exporter-test")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	notAfter := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second)
+	certFile, keyFile := testCertificate(t, dir, notAfter)
+
+	f := serveFakeClamD(listenTLS(t, certFile, keyFile))
+	defer f.Close()
+	_, port, err := net.SplitHostPort(f.l.Addr().String())
+	r.NoError(err)
+
+	values := gatherMetrics(t, NewClamDChecker("", ClamDOptions{
+		URL: "tcp://" + net.JoinHostPort("127.0.0.1", port),
+		TLS: &TLSOptions{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, ServerName: "localhost"},
+	}))
+	r.Equal(1.0, values["clamav_clamd_up"])
+	r.Equal(float64(notAfter.Unix()), values["clamav_clamd_tls_cert_expiry_timestamp_seconds"])
+	r.True(values["clamav_clamd_tls_handshake_seconds"] > 0)
+
+	// the certificate is not trusted without the CA
+	values = gatherMetrics(t, NewClamDChecker("", ClamDOptions{
+		URL: "tcp://" + net.JoinHostPort("127.0.0.1", port),
+		TLS: &TLSOptions{CertFile: certFile, KeyFile: keyFile, ServerName: "localhost"},
+	}))
+	r.Equal(0.0, values["clamav_clamd_up"])
+	r.NotContains(values, "clamav_clamd_tls_handshake_seconds")
+}
+
+func TestIcapCheckerTLS(t *testing.T) {
+	r := require.New(t)
+	dir, err := ioutil.TempDir("", "clamav-exporter-test")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	notAfter := time.Now().Add(7 * 24 * time.Hour).Truncate(time.Second)
+	certFile, keyFile := testCertificate(t, dir, notAfter)
+
+	f := serveFakeIcap(listenTLS(t, certFile, keyFile))
+	defer f.Close()
+	opts := f.options()
+	opts.Host = "localhost"
+	opts.TLS = &TLSOptions{CAFile: certFile, CertFile: certFile, KeyFile: keyFile}
+	r.NoError(opts.validate())
+
+	c := NewIcapChecker("", opts)
+	r.Equal("icaps://"+net.JoinHostPort("localhost", opts.Port)+"/squidclamav", c.target())
+	values := gatherMetrics(t, c)
+	r.Equal(1.0, values["clamav_icap_eicar_detected"])
+	r.Equal(1.0, values["clamav_icap_hello_ok"])
+	r.Equal(200.0, values["clamav_icap_options_status_code"])
+	r.Equal(float64(notAfter.Unix()), values["clamav_icap_tls_cert_expiry_timestamp_seconds"])
+	r.True(values["clamav_icap_tls_handshake_seconds"] > 0)
+
+	// the TLS state is the one of the connection of the OPTIONS request,
+	// which reuses the connection of the EICAR request with keep-alive
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts.KeepAlive = true
+	opts.Parallelism = 1
+	res := NewIcapChecker("", opts).probe(ctx)
+	r.NotNil(res.tls)
+	r.True(res.tls == res.optionsTrace.tls)
+	r.True(res.tls == res.eicarTrace.tls)
+
+	// the handshake fails without a client certificate
+	c = NewIcapChecker("", IcapOptions{Host: "localhost", Port: opts.Port, TLS: &TLSOptions{CAFile: certFile}})
+	_, _, err = c.collectOptions(ctx, c.newSession())
+	r.Error(err)
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultUpstreamRefresh is the interval of the lookups, the published
+// versions change only a few times a day.
+const defaultUpstreamRefresh = 30 * time.Minute
+
+// UpstreamOptions configures the DNS lookup of the published database
+// versions, which is the same lookup freshclam does before an update.
+type UpstreamOptions struct {
+	// Record is the TXT record, e.g. of a local mirror
+	Record string `json:"record"`
+	// Resolver is the address of the DNS server, the system resolver is used
+	// if it is empty
+	Resolver string `json:"resolver"`
+	// Refresh is the interval in which the record is looked up again, the
+	// version is cached in between (default 30m)
+	Refresh Duration `json:"refresh"`
+}
+
+func (o UpstreamOptions) withDefaults() UpstreamOptions {
+	if o.Record == "" {
+		o.Record = "current.cvd.clamav.net"
+	}
+	if o.Refresh.Duration <= 0 {
+		o.Refresh.Duration = defaultUpstreamRefresh
+	}
+	if o.Resolver != "" {
+		if _, _, err := net.SplitHostPort(o.Resolver); err != nil {
+			o.Resolver = net.JoinHostPort(o.Resolver, "53")
+		}
+	}
+	return o
+}
+
+func (o UpstreamOptions) resolver() *net.Resolver {
+	if o.Resolver == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, o.Resolver)
+		},
+	}
+}
+
+// parseUpstreamTXT returns the daily version of a TXT record like
+//
+//	0.102.1:59:25703:1579870080:1:63:49191:331
+//
+// whose fields are the recommended engine version, the main, daily and
+// bytecode versions among others.
+func parseUpstreamTXT(txt string) (daily int, err error) {
+	f := strings.Split(txt, ":")
+	if len(f) < 3 {
+		return 0, fmt.Errorf("invalid upstream TXT record %q", txt)
+	}
+	if daily, err = strconv.Atoi(f[2]); err != nil {
+		return 0, fmt.Errorf("invalid daily version in upstream TXT record %q", txt)
+	}
+	return daily, nil
+}
+
+// lookupUpstreamVersion returns the daily version published by the TXT
+// record.
+func lookupUpstreamVersion(ctx context.Context, opts UpstreamOptions) (int, error) {
+	txts, err := opts.resolver().LookupTXT(ctx, opts.Record)
+	if err != nil {
+		return 0, err
+	}
+	if len(txts) == 0 {
+		return 0, fmt.Errorf("no TXT record found for %q", opts.Record)
+	}
+	return parseUpstreamTXT(txts[0])
+}
+
+// upstreamCache caches the published daily version, so that it is looked up
+// once per refresh interval instead of on every scrape.
+type upstreamCache struct {
+	opts UpstreamOptions
+	now  func() time.Time
+
+	mu      sync.Mutex
+	version int
+	updated time.Time
+}
+
+func newUpstreamCache(opts UpstreamOptions) *upstreamCache {
+	return &upstreamCache{opts: opts, now: time.Now}
+}
+
+// get returns the cached version or looks it up if it is older than the
+// refresh interval. If the lookup fails, the last version is returned along
+// with the error, it is 0 if no lookup has succeeded yet.
+func (u *upstreamCache) get(ctx context.Context) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.updated.IsZero() && u.now().Sub(u.updated) < u.opts.Refresh.Duration {
+		return u.version, nil
+	}
+	version, err := lookupUpstreamVersion(ctx, u.opts)
+	if err != nil {
+		return u.version, err
+	}
+	u.version, u.updated = version, u.now()
+	return version, nil
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	dnsTypeTXT = 16
+	dnsClassIN = 1
+)
+
+// fakeDNS answers TXT queries over UDP with the configured records, other
+// names get NXDOMAIN.
+type fakeDNS struct {
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	records map[string]string
+}
+
+func newFakeDNS(t *testing.T, records map[string]string) *fakeDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeDNS{conn: conn, records: records}
+	go f.serve()
+	return f
+}
+
+func (f *fakeDNS) Close() error {
+	return f.conn.Close()
+}
+
+func (f *fakeDNS) Addr() string {
+	return f.conn.LocalAddr().String()
+}
+
+func (f *fakeDNS) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if reply := f.reply(buf[:n]); reply != nil {
+			f.conn.WriteTo(reply, addr)
+		}
+	}
+}
+
+// reply builds the response to a query with a single question.
+func (f *fakeDNS) reply(query []byte) []byte {
+	if len(query) < 12 || binary.BigEndian.Uint16(query[4:]) != 1 {
+		return nil
+	}
+	// the question name is a sequence of length prefixed labels
+	var labels []string
+	off := 12
+	for off < len(query) && query[off] != 0 {
+		l := int(query[off])
+		if off+1+l > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[off+1:off+1+l]))
+		off += 1 + l
+	}
+	off += 1 + 4 // terminating zero label, type and class
+	if off > len(query) {
+		return nil
+	}
+	name := strings.Join(labels, ".")
+	qtype := binary.BigEndian.Uint16(query[off-4:])
+
+	f.mu.Lock()
+	txt, ok := f.records[name]
+	f.mu.Unlock()
+
+	reply := make([]byte, 12, 512)
+	copy(reply, query[:2])
+	flags := uint16(0x8180) // response, recursion desired and available
+	if !ok {
+		flags |= 3 // NXDOMAIN
+	}
+	binary.BigEndian.PutUint16(reply[2:], flags)
+	binary.BigEndian.PutUint16(reply[4:], 1)
+	reply = append(reply, query[12:off]...)
+	if !ok || qtype != dnsTypeTXT {
+		return reply
+	}
+
+	binary.BigEndian.PutUint16(reply[6:], 1)
+	rr := make([]byte, 12)
+	binary.BigEndian.PutUint16(rr[0:], 0xc00c) // pointer to the question name
+	binary.BigEndian.PutUint16(rr[2:], dnsTypeTXT)
+	binary.BigEndian.PutUint16(rr[4:], dnsClassIN)
+	binary.BigEndian.PutUint32(rr[6:], 60)
+	binary.BigEndian.PutUint16(rr[10:], uint16(1+len(txt)))
+	rr = append(rr, byte(len(txt)))
+	rr = append(rr, txt...)
+	return append(reply, rr...)
+}
+
+func TestParseUpstreamTXT(t *testing.T) {
+	r := require.New(t)
+
+	daily, err := parseUpstreamTXT("0.102.1:59:25703:1579870080:1:63:49191:331")
+	r.NoError(err)
+	r.Equal(25703, daily)
+
+	_, err = parseUpstreamTXT("0.102.1:59")
+	r.Error(err)
+	_, err = parseUpstreamTXT("0.102.1:59:latest")
+	r.Error(err)
+}
+
+func TestLookupUpstreamVersion(t *testing.T) {
+	r := require.New(t)
+	dns := newFakeDNS(t, map[string]string{
+		"current.cvd.clamav.net":     "0.102.1:59:25703:1579870080:1:63:49191:331",
+		"current.cvd.mirror.example": "0.102.1:59:25702:1579783680:1:63:49191:331",
+	})
+	defer dns.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	version, err := lookupUpstreamVersion(ctx, UpstreamOptions{Resolver: dns.Addr()}.withDefaults())
+	r.NoError(err)
+	r.Equal(25703, version)
+
+	version, err = lookupUpstreamVersion(ctx, UpstreamOptions{
+		Record:   "current.cvd.mirror.example",
+		Resolver: dns.Addr(),
+	}.withDefaults())
+	r.NoError(err)
+	r.Equal(25702, version)
+
+	_, err = lookupUpstreamVersion(ctx, UpstreamOptions{
+		Record:   "current.cvd.missing.example",
+		Resolver: dns.Addr(),
+	}.withDefaults())
+	r.Error(err)
+}
+
+func TestClamDVersionsBehind(t *testing.T) {
+	r := require.New(t)
+	f := newFakeClamD(t)
+	defer f.Close()
+	dns := newFakeDNS(t, map[string]string{
+		"current.cvd.clamav.net": "0.102.1:59:25703:1579870080:1:63:49191:331",
+	})
+	defer dns.Close()
+
+	// clamd reports daily version 25701
+	c := NewClamDChecker("", ClamDOptions{
+		URL:      f.URL(),
+		Upstream: &UpstreamOptions{Resolver: dns.Addr()},
+	})
+	values := gatherMetrics(t, c)
+	r.Equal(25703.0, values["clamav_upstream_daily_version"])
+	r.Equal(2.0, values["clamav_clamd_db_versions_behind"])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the version is cached, the record is not looked up again
+	dns.Close()
+	res := c.probe(ctx)
+	r.NoError(probeErr(res.probes, "upstream"))
+	r.Equal(25703.0, res.upstreamVersion)
+
+	// the lookup fails once the cache has expired, the last version is used
+	now := time.Now().Add(time.Hour)
+	c.upstream.now = func() time.Time { return now }
+	res = c.probe(ctx)
+	r.Error(probeErr(res.probes, "upstream"))
+	r.Equal(25703.0, res.upstreamVersion)
+
+	// the number of versions is unknown without a successful lookup
+	c = NewClamDChecker("", ClamDOptions{
+		URL:      f.URL(),
+		Upstream: &UpstreamOptions{Resolver: dns.Addr()},
+	})
+	res = c.probe(ctx)
+	r.Error(probeErr(res.probes, "upstream"))
+	r.True(math.IsNaN(res.upstreamVersion))
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scanVerdict is the outcome of a probe which scans a stream whose verdict is
+// known in advance, e.g. EICAR is expected to be detected.
+type scanVerdict struct {
+	probe    string
+	infected bool
+	detected bool
+	err      error
+}
+
+// verdictTracker counts the verdicts of the scan probes of a checker across
+// scrapes, so that a detection which flapped between two scrapes still shows
+// up in increase() queries.
+type verdictTracker struct {
+	promProbes         *prometheus.CounterVec
+	promDetections     *prometheus.CounterVec
+	promMisses         *prometheus.CounterVec
+	promErrors         *prometheus.CounterVec
+	promFalsePositives *prometheus.CounterVec
+	promLastChange     *prometheus.Desc
+
+	// mu protects the last verdict of every probe and when it changed
+	mu      sync.Mutex
+	last    map[string]bool
+	changed map[string]time.Time
+}
+
+func newVerdictTracker(checker string, probes []string, constLabels prometheus.Labels) *verdictTracker {
+	counter := func(name, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "clamav_" + checker + "_scan_" + name + "_total",
+			Help:        help,
+			ConstLabels: constLabels,
+		}, []string{"probe"})
+	}
+	t := &verdictTracker{
+		promProbes:         counter("probes", "number of scan probes run"),
+		promDetections:     counter("detections", "number of scan probes in which a threat was detected"),
+		promMisses:         counter("misses", "number of scan probes in which an expected threat was not detected"),
+		promErrors:         counter("errors", "number of scan probes which failed without a verdict"),
+		promFalsePositives: counter("false_positives", "number of scan probes in which a threat was detected in a clean stream"),
+		promLastChange: prometheus.NewDesc(
+			"clamav_"+checker+"_scan_verdict_change_timestamp_seconds",
+			"unix epoch timestamp of the last change of the verdict of the probe, the first verdict counts as a change",
+			[]string{"probe"},
+			constLabels),
+		last:    make(map[string]bool),
+		changed: make(map[string]time.Time),
+	}
+	for _, probe := range probes {
+		for _, c := range t.counters() {
+			c.WithLabelValues(probe)
+		}
+	}
+	return t
+}
+
+func (t *verdictTracker) counters() []*prometheus.CounterVec {
+	return []*prometheus.CounterVec{
+		t.promProbes,
+		t.promDetections,
+		t.promMisses,
+		t.promErrors,
+		t.promFalsePositives,
+	}
+}
+
+// observe counts the verdicts of a probe run at time now.
+func (t *verdictTracker) observe(now time.Time, verdicts []scanVerdict) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, v := range verdicts {
+		t.promProbes.WithLabelValues(v.probe).Inc()
+		if v.err != nil {
+			t.promErrors.WithLabelValues(v.probe).Inc()
+			continue
+		}
+		switch {
+		case v.detected && !v.infected:
+			t.promFalsePositives.WithLabelValues(v.probe).Inc()
+		case !v.detected && v.infected:
+			t.promMisses.WithLabelValues(v.probe).Inc()
+		}
+		if v.detected {
+			t.promDetections.WithLabelValues(v.probe).Inc()
+		}
+		if last, ok := t.last[v.probe]; !ok || last != v.detected {
+			t.last[v.probe] = v.detected
+			t.changed[v.probe] = now
+		}
+	}
+}
+
+func (t *verdictTracker) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range t.counters() {
+		c.Describe(ch)
+	}
+	ch <- t.promLastChange
+}
+
+func (t *verdictTracker) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range t.counters() {
+		c.Collect(ch)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for probe, changed := range t.changed {
+		ch <- prometheus.MustNewConstMetric(
+			t.promLastChange,
+			prometheus.GaugeValue,
+			float64(changed.UnixNano())/1e9,
+			probe,
+		)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2020 mgIT GmbH. All rights reserved.
+// Distributed under the Apache License. See LICENSE for details.
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerdictTracker(t *testing.T) {
+	r := require.New(t)
+	vt := newVerdictTracker("test", []string{"eicar", "hello"}, nil)
+
+	values := gatherMetrics(t, vt, "probe")
+	r.Equal(0.0, values["clamav_test_scan_probes_total/eicar"])
+	r.Equal(0.0, values["clamav_test_scan_misses_total/hello"])
+	r.NotContains(values, "clamav_test_scan_verdict_change_timestamp_seconds/eicar")
+
+	start := time.Unix(1579524103, 0)
+	failed := errors.New("failed")
+	runs := []struct {
+		eicar, hello scanVerdict
+	}{
+		{scanVerdict{"eicar", true, true, nil}, scanVerdict{"hello", false, false, nil}},
+		// EICAR missed and hello flagged for a single probe between scrapes
+		{scanVerdict{"eicar", true, false, nil}, scanVerdict{"hello", false, true, nil}},
+		{scanVerdict{"eicar", true, true, nil}, scanVerdict{"hello", false, false, nil}},
+		{scanVerdict{"eicar", true, false, failed}, scanVerdict{"hello", false, false, nil}},
+	}
+	for i, run := range runs {
+		vt.observe(start.Add(time.Duration(i)*time.Minute), []scanVerdict{run.eicar, run.hello})
+	}
+
+	values = gatherMetrics(t, vt, "probe")
+	r.Equal(4.0, values["clamav_test_scan_probes_total/eicar"])
+	r.Equal(2.0, values["clamav_test_scan_detections_total/eicar"])
+	r.Equal(1.0, values["clamav_test_scan_misses_total/eicar"])
+	r.Equal(1.0, values["clamav_test_scan_errors_total/eicar"])
+	r.Equal(0.0, values["clamav_test_scan_false_positives_total/eicar"])
+	r.Equal(4.0, values["clamav_test_scan_probes_total/hello"])
+	r.Equal(1.0, values["clamav_test_scan_detections_total/hello"])
+	r.Equal(0.0, values["clamav_test_scan_misses_total/hello"])
+	r.Equal(1.0, values["clamav_test_scan_false_positives_total/hello"])
+
+	// errors have no verdict and do not change it
+	r.Equal(float64(start.Add(2*time.Minute).Unix()), values["clamav_test_scan_verdict_change_timestamp_seconds/eicar"])
+	r.Equal(float64(start.Add(2*time.Minute).Unix()), values["clamav_test_scan_verdict_change_timestamp_seconds/hello"])
+}